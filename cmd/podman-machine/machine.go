@@ -135,6 +135,17 @@ func main() {
 			Usage:  "Token to use for requests to the Github API",
 			Value:  "",
 		},
+		cli.StringFlag{
+			EnvVar: "MACHINE_RELEASE_SOURCE",
+			Name:   "release-source",
+			Usage:  "Where to find the ISO releases: github, a Github releases API URL, or the URL or path of a mirror",
+			Value:  "",
+		},
+		cli.BoolFlag{
+			EnvVar: "MACHINE_OFFLINE",
+			Name:   "offline",
+			Usage:  "Only use the image cache and local mirrors, never download from the network",
+		},
 		cli.BoolFlag{
 			EnvVar: "MACHINE_NATIVE_SSH",
 			Name:   "native-ssh",
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/thelonelyghost/p2box/commands/mcndirs"
 	"github.com/thelonelyghost/p2box/libmachine"
@@ -52,6 +53,8 @@ type CommandLine interface {
 
 	GlobalString(name string) string
 
+	GlobalBool(name string) bool
+
 	FlagNames() (names []string)
 
 	Generic(name string) interface{}
@@ -93,6 +96,17 @@ func targetHost(c CommandLine, api libmachine.API) (string, error) {
 }
 
 func runAction(actionName string, c CommandLine, api libmachine.API) error {
+	hosts, err := loadActionHosts(c, api)
+	if err != nil {
+		return err
+	}
+
+	return runActionOnHosts(actionName, hosts, api)
+}
+
+// loadActionHosts loads the machines named on the command line, or the
+// default machine when none are named.
+func loadActionHosts(c CommandLine, api libmachine.API) ([]*host.Host, error) {
 	var (
 		hostsToLoad []string
 	)
@@ -103,7 +117,7 @@ func runAction(actionName string, c CommandLine, api libmachine.API) error {
 	if len(c.Args()) == 0 {
 		target, err := targetHost(c, api)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		hostsToLoad = []string{target}
@@ -118,14 +132,38 @@ func runAction(actionName string, c CommandLine, api libmachine.API) error {
 		for _, err := range hostsInError {
 			errs = append(errs, err)
 		}
-		return consolidateErrs(errs)
+		return nil, consolidateErrs(errs)
 	}
 
 	if len(hosts) == 0 {
-		return ErrHostLoad
+		return nil, ErrHostLoad
+	}
+
+	return hosts, nil
+}
+
+// runActionOnHosts runs the action on each machine, then saves them.
+func runActionOnHosts(actionName string, hosts []*host.Host, api libmachine.API) error {
+	return runActionFuncOnHosts(func(h *host.Host) error {
+		return machineCommand(actionName, h)
+	}, hosts, api)
+}
+
+// runActionFunc is runAction for the actions which take arguments, given
+// as a function of the machine.
+func runActionFunc(action func(*host.Host) error, c CommandLine, api libmachine.API) error {
+	hosts, err := loadActionHosts(c, api)
+	if err != nil {
+		return err
 	}
 
-	if errs := runActionForeachMachine(actionName, hosts); len(errs) > 0 {
+	return runActionFuncOnHosts(action, hosts, api)
+}
+
+// runActionFuncOnHosts runs the action function on each machine, then saves
+// them.
+func runActionFuncOnHosts(action func(*host.Host) error, hosts []*host.Host, api libmachine.API) error {
+	if errs := runFuncForeachMachine(action, hosts); len(errs) > 0 {
 		return consolidateErrs(errs)
 	}
 
@@ -158,6 +196,13 @@ func runCommand(command func(commandLine CommandLine, api libmachine.API) error)
 		mcnutils.GithubAPIToken = api.GithubAPIToken
 		ssh.SetDefaultClient(api.SSHClientType)
 
+		if err := configureDownloads(&contextCommandLine{context}, api.Filestore.Path); err != nil {
+			log.Error(err)
+
+			osExit(1)
+			return
+		}
+
 		if err := command(&contextCommandLine{context}, api); err != nil {
 			log.Error(err)
 
@@ -231,6 +276,56 @@ var Commands = []cli.Command{
 			},
 		},
 	},
+	{
+		Name:  "image",
+		Usage: "Manage the cached ISOs and base images",
+		Subcommands: []cli.Command{
+			{
+				Name:   "ls",
+				Usage:  "List the cached images, with the machines using them",
+				Action: runCommand(cmdImageLs),
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "quiet, q",
+						Usage: "Only print the image names",
+					},
+					cli.BoolFlag{
+						Name:  "no-trunc",
+						Usage: "Print the whole digests",
+					},
+				},
+			},
+			{
+				Name:        "pull",
+				Usage:       "Download an image to the cache",
+				Description: "Argument is a release tag of the ISO, or the URL or path of a base image. Without it, the latest ISO is downloaded.",
+				Action:      runCommand(cmdImagePull),
+			},
+			{
+				Name:        "rm",
+				Usage:       "Remove images from the cache",
+				Description: "Argument(s) are one or more image names.",
+				Action:      runCommand(cmdImageRm),
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "force, f",
+						Usage: "Remove images even if machines use them",
+					},
+				},
+			},
+			{
+				Name:   "prune",
+				Usage:  "Remove the images no machine uses from the cache",
+				Action: runCommand(cmdImagePrune),
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "force, f",
+						Usage: "Do not prompt for confirmation",
+					},
+				},
+			},
+		},
+	},
 	{
 		Name:        "inspect",
 		Usage:       "Inspect information about a machine",
@@ -256,6 +351,23 @@ var Commands = []cli.Command{
 		Description: "Argument(s) are one or more machine names.",
 		Action:      runCommand(cmdKill),
 	},
+	{
+		Name:        "login-sync",
+		Usage:       "Copy the registry credentials of this host to a machine",
+		Description: "Argument is a machine name.",
+		Action:      runCommand(cmdLoginSync),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "authfile",
+				Usage: "Auth file to copy instead of the one podman login writes to",
+			},
+			cli.StringSliceFlag{
+				Name:  "registry",
+				Usage: "Only copy the credentials of this registry, can be repeated",
+				Value: &cli.StringSlice{},
+			},
+		},
+	},
 	{
 		Name:   "ls",
 		Usage:  "List machines",
@@ -285,6 +397,16 @@ var Commands = []cli.Command{
 		Name:   "provision",
 		Usage:  "Re-provision existing machines",
 		Action: runCommand(cmdProvision),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "provisioner",
+				Usage: "Name of the provisioner to use instead of detecting it, saved for later commands",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Show what provisioning would change, without changing anything",
+			},
+		},
 	},
 	{
 		Name:        "regenerate-certs",
@@ -380,12 +502,33 @@ var Commands = []cli.Command{
 		Usage:       "Stop a machine",
 		Description: "Argument(s) are one or more machine names.",
 		Action:      runCommand(cmdStop),
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "timeout, t",
+				Usage: "Seconds to wait for the machine to shut down before killing it, 0 to kill it right away",
+				Value: int(host.DefaultStopTimeout / time.Second),
+			},
+			cli.BoolFlag{
+				Name:  "force, f",
+				Usage: "Kill the machine without waiting for it to shut down",
+			},
+		},
 	},
 	{
 		Name:        "upgrade",
 		Usage:       "Upgrade a machine to the latest version of Podman",
 		Description: "Argument(s) are one or more machine names.",
 		Action:      runCommand(cmdUpgrade),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "to",
+				Usage: "Version to upgrade or downgrade to: a release tag of the ISO on boot2podman, a package version elsewhere",
+			},
+			cli.BoolFlag{
+				Name:  "rollback",
+				Usage: "Return to the version from before the last upgrade",
+			},
+		},
 	},
 	{
 		Name:        "url",
@@ -413,9 +556,9 @@ func printIP(h *host.Host) func() error {
 	}
 }
 
-// machineCommand maps the command name to the corresponding machine command.
-// We run commands concurrently and communicate back an error if there was one.
-func machineCommand(actionName string, host *host.Host, errorChan chan<- error) {
+// machineCommand maps the command name to the corresponding machine command,
+// and runs it.
+func machineCommand(actionName string, host *host.Host) error {
 	// TODO: These actions should have their own type.
 	commands := map[string](func() error){
 		"configureAuth":    host.ConfigureAuth,
@@ -431,11 +574,19 @@ func machineCommand(actionName string, host *host.Host, errorChan chan<- error)
 
 	log.Debugf("command=%s machine=%s", actionName, host.Name)
 
-	errorChan <- commands[actionName]()
+	return commands[actionName]()
 }
 
 // runActionForeachMachine will run the command across multiple machines
 func runActionForeachMachine(actionName string, machines []*host.Host) []error {
+	return runFuncForeachMachine(func(h *host.Host) error {
+		return machineCommand(actionName, h)
+	}, machines)
+}
+
+// runFuncForeachMachine runs the action across multiple machines. We run
+// actions concurrently and communicate back an error if there was one.
+func runFuncForeachMachine(action func(*host.Host) error, machines []*host.Host) []error {
 	var (
 		numConcurrentActions = 0
 		errorChan            = make(chan error)
@@ -444,7 +595,9 @@ func runActionForeachMachine(actionName string, machines []*host.Host) []error {
 
 	for _, machine := range machines {
 		numConcurrentActions++
-		go machineCommand(actionName, machine, errorChan)
+		go func(machine *host.Host) {
+			errorChan <- action(machine)
+		}(machine)
 	}
 
 	// TODO: We should probably only do 5-10 of these
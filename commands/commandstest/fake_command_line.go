@@ -43,11 +43,17 @@ func (ff FakeFlagger) Bool(key string) bool {
 }
 
 func (fcli *FakeCommandLine) IsSet(key string) bool {
+	if fcli.LocalFlags == nil {
+		return false
+	}
 	_, ok := fcli.LocalFlags.Data[key]
 	return ok
 }
 
 func (fcli *FakeCommandLine) String(key string) string {
+	if fcli.LocalFlags == nil {
+		return ""
+	}
 	return fcli.LocalFlags.String(key)
 }
 
@@ -70,6 +76,13 @@ func (fcli *FakeCommandLine) GlobalString(key string) string {
 	return fcli.GlobalFlags.String(key)
 }
 
+func (fcli *FakeCommandLine) GlobalBool(key string) bool {
+	if fcli.GlobalFlags == nil {
+		return false
+	}
+	return fcli.GlobalFlags.Bool(key)
+}
+
 func (fcli *FakeCommandLine) Generic(name string) interface{} {
 	return fcli.LocalFlags.Data[name]
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/thelonelyghost/p2box/libmachine"
+	"github.com/thelonelyghost/p2box/libmachine/host"
 	"github.com/thelonelyghost/p2box/libmachine/log"
 )
 
@@ -42,8 +43,7 @@ func cmdConfig(c CommandLine, api libmachine.API) error {
 	key := host.Driver.GetSSHKeyPath()
 
 	if addr != "" {
-		// always use root@ for socket
-		user = "root"
+		user = podmanSocketUser(host)
 	}
 
 	fmt.Printf("--username=%s\n--host=%s\n--port=%d\n--identity-file=%s\n",
@@ -51,3 +51,13 @@ func cmdConfig(c CommandLine, api libmachine.API) error {
 
 	return nil
 }
+
+// podmanSocketUser returns the user whose Podman socket clients connect to:
+// the SSH user for rootless machines, root otherwise.
+func podmanSocketUser(h *host.Host) string {
+	if h.HostOptions != nil && h.HostOptions.EngineOptions != nil && h.HostOptions.EngineOptions.Rootless {
+		return h.Driver.GetSSHUsername()
+	}
+
+	return "root"
+}
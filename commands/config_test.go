@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/host"
+	"github.com/stretchr/testify/assert"
+)
+
+type sshUserDriver struct {
+	fakedriver.Driver
+}
+
+func (d *sshUserDriver) GetSSHUsername() string {
+	return "core"
+}
+
+func TestPodmanSocketUser(t *testing.T) {
+	h := &host.Host{
+		Driver: &sshUserDriver{},
+		HostOptions: &host.Options{
+			EngineOptions: &engine.Options{},
+		},
+	}
+	assert.Equal(t, "root", podmanSocketUser(h))
+
+	h.HostOptions.EngineOptions.Rootless = true
+	assert.Equal(t, "core", podmanSocketUser(h))
+}
@@ -21,6 +21,8 @@ import (
 	"github.com/thelonelyghost/p2box/libmachine/log"
 	"github.com/thelonelyghost/p2box/libmachine/mcnerror"
 	"github.com/thelonelyghost/p2box/libmachine/mcnflag"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+	"github.com/thelonelyghost/p2box/libmachine/provision"
 	"github.com/urfave/cli"
 )
 
@@ -67,11 +69,64 @@ var (
 			Name:  "engine-storage-driver",
 			Usage: "Specify a storage driver to use with the engine",
 		},
+		cli.StringSliceFlag{
+			Name:  "engine-storage-opt",
+			Usage: "Specify storage options for the engine in the form key=value, e.g. overlay.mountopt=nodev,metacopy=on",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "engine-graph-dir",
+			Usage: "Specify the directory where the engine stores images and containers",
+		},
+		cli.BoolFlag{
+			Name:  "engine-rootless",
+			Usage: "Run Podman as the SSH user instead of root",
+		},
+		cli.StringFlag{
+			Name:  "engine-proxy",
+			Usage: "Proxy for the engine, the package manager and downloads: auto to use the proxy environment variables, none, or a URL",
+		},
+		cli.StringSliceFlag{
+			Name:  "trust-ca",
+			Usage: "Trust a CA certificate file on the machine, or only for a registry in the form REGISTRY=FILE, can be repeated",
+			Value: &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:  "inherit-host-cas",
+			Usage: "Trust the CA certificates of this host on the machine",
+		},
 		cli.StringSliceFlag{
 			Name:  "engine-env",
 			Usage: "Specify environment variables to set in the engine",
 			Value: &cli.StringSlice{},
 		},
+		cli.StringFlag{
+			Name:  "provisioner",
+			Usage: "Name of the provisioner to use instead of detecting it from the OS of the machine",
+		},
+		cli.StringSliceFlag{
+			Name:  "provision-script",
+			Usage: "Run a local shell script on the machine as root after provisioning, can be repeated",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			Name:  "copy-file",
+			Usage: "Copy a local file to the machine after provisioning, in the form LOCAL:REMOTE[:mode]",
+			Value: &cli.StringSlice{},
+		},
+		cli.BoolFlag{
+			Name:  "sync-registry-auth",
+			Usage: "Copy the registry credentials of this host to the machine when it is provisioned or started",
+		},
+		cli.StringFlag{
+			Name:  "registry-authfile",
+			Usage: "Auth file to copy with --sync-registry-auth instead of the one podman login writes to",
+		},
+		cli.StringSliceFlag{
+			Name:  "sync-registry",
+			Usage: "Only copy the credentials of this registry with --sync-registry-auth, can be repeated",
+			Value: &cli.StringSlice{},
+		},
 		cli.StringSliceFlag{
 			Name:  "tls-san",
 			Usage: "Support extra SANs for TLS certs",
@@ -96,6 +151,94 @@ func cmdCreateInner(c CommandLine, api libmachine.API) error {
 		return fmt.Errorf("Error creating machine: %s", mcnerror.ErrInvalidHostname)
 	}
 
+	provisionerName := c.String("provisioner")
+	if provisionerName != "" && !provision.IsRegistered(provisionerName) {
+		return fmt.Errorf("Unknown provisioner %q, must be one of: %s", provisionerName, strings.Join(provision.Names(), ", "))
+	}
+
+	for _, opt := range c.StringSlice("engine-storage-opt") {
+		if !strings.Contains(opt, "=") {
+			return fmt.Errorf("Invalid storage option %q, expected key=value", opt)
+		}
+	}
+
+	// the paths are saved, and used again by later provisions from
+	// any directory
+	provisionScripts := []string{}
+	for _, script := range c.StringSlice("provision-script") {
+		absScript, err := filepath.Abs(script)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absScript); err != nil {
+			return fmt.Errorf("Error reading provisioning script: %s", err)
+		}
+		provisionScripts = append(provisionScripts, absScript)
+	}
+
+	copyFiles := []string{}
+	for _, spec := range c.StringSlice("copy-file") {
+		local, remote, mode, err := provision.ParseCopyFile(spec)
+		if err != nil {
+			return err
+		}
+		absLocal, err := filepath.Abs(local)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absLocal); err != nil {
+			return fmt.Errorf("Error reading file to copy: %s", err)
+		}
+		copyFiles = append(copyFiles, fmt.Sprintf("%s:%s:%o", absLocal, remote, mode))
+	}
+
+	trustCAs := []string{}
+	for _, spec := range c.StringSlice("trust-ca") {
+		registry, file, err := provision.ParseTrustCA(spec)
+		if err != nil {
+			return err
+		}
+		absFile, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absFile); err != nil {
+			return fmt.Errorf("Error reading CA certificate: %s", err)
+		}
+		if registry != "" {
+			absFile = registry + "=" + absFile
+		}
+		trustCAs = append(trustCAs, absFile)
+	}
+
+	if c.Bool("inherit-host-cas") {
+		if _, err := provision.FindHostCABundle(); err != nil {
+			return err
+		}
+	}
+
+	registryAuthFile := ""
+	if c.String("registry-authfile") != "" {
+		absAuthFile, err := filepath.Abs(c.String("registry-authfile"))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absAuthFile); err != nil {
+			return fmt.Errorf("Error reading registry credentials: %s", err)
+		}
+		registryAuthFile = absAuthFile
+	}
+
+	if err := mcnutils.ConfigureProxy(c.String("engine-proxy")); err != nil {
+		return err
+	}
+	// the settings file may have a default proxy
+	proxyValue := c.String("engine-proxy")
+	if proxyValue == "" {
+		proxyValue = mcnutils.DefaultProxy
+	}
+	httpProxy, httpsProxy, noProxy := engineProxy(proxyValue)
+
 	// TODO: Fix hacky JSON solution
 	rawDriver, err := json.Marshal(&drivers.BaseDriver{
 		MachineName: name,
@@ -130,9 +273,23 @@ func cmdCreateInner(c CommandLine, api libmachine.API) error {
 			Labels:           c.StringSlice("engine-label"),
 			RegistryMirror:   c.StringSlice("engine-registry-mirror"),
 			StorageDriver:    c.String("engine-storage-driver"),
+			StorageOpts:      c.StringSlice("engine-storage-opt"),
+			GraphDir:         c.String("engine-graph-dir"),
+			Rootless:         c.Bool("engine-rootless"),
+			HTTPProxy:        httpProxy,
+			HTTPSProxy:       httpsProxy,
+			NoProxy:          noProxy,
+			TrustCAs:         trustCAs,
+			InheritHostCAs:   c.Bool("inherit-host-cas"),
 			TLSVerify:        true,
 			InstallURL:       c.String("engine-install-url"),
 		},
+		Provisioner:      provisionerName,
+		CopyFiles:        copyFiles,
+		ProvisionScripts: provisionScripts,
+		SyncRegistryAuth: c.Bool("sync-registry-auth"),
+		RegistryAuthFile: registryAuthFile,
+		SyncRegistries:   c.StringSlice("sync-registry"),
 	}
 
 	exists, err := api.Exists(h.Name)
@@ -256,6 +413,33 @@ func cmdCreateOuter(c CommandLine, api libmachine.API) error {
 	return c.Application().Run(os.Args)
 }
 
+// engineProxy returns the HTTP, HTTPS and no proxy settings of the engine
+// from the value of the engine-proxy flag, already validated by
+// mcnutils.ConfigureProxy.
+func engineProxy(value string) (string, string, string) {
+	_, noProxy := findNoProxyFromEnv()
+
+	switch value {
+	case "", "none":
+		return "", "", ""
+	case "auto":
+		httpProxy := os.Getenv("http_proxy")
+		if httpProxy == "" {
+			httpProxy = os.Getenv("HTTP_PROXY")
+		}
+		httpsProxy := os.Getenv("https_proxy")
+		if httpsProxy == "" {
+			httpsProxy = os.Getenv("HTTPS_PROXY")
+		}
+		if httpProxy == "" && httpsProxy == "" {
+			return "", "", ""
+		}
+		return httpProxy, httpsProxy, noProxy
+	default:
+		return value, value, noProxy
+	}
+}
+
 func getDriverOpts(c CommandLine, mcnflags []mcnflag.Flag) drivers.DriverOptions {
 	// TODO: This function is pretty damn YOLO and would benefit from some
 	// sanity checking around types and assertions.
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"os"
 	"testing"
 
 	"flag"
@@ -102,3 +103,31 @@ func TestGetDriverOpts(t *testing.T) {
 		assert.Equal(t, tt.expected["stringslice_defaulted"], driverOpts.StringSlice("stringslice_defaulted"))
 	}
 }
+
+func TestEngineProxy(t *testing.T) {
+	defer func(httpProxy, httpsProxy, noProxy string) {
+		os.Setenv("HTTP_PROXY", httpProxy)
+		os.Setenv("HTTPS_PROXY", httpsProxy)
+		os.Setenv("NO_PROXY", noProxy)
+	}(os.Getenv("HTTP_PROXY"), os.Getenv("HTTPS_PROXY"), os.Getenv("NO_PROXY"))
+
+	os.Unsetenv("http_proxy")
+	os.Unsetenv("https_proxy")
+	os.Unsetenv("no_proxy")
+	os.Setenv("HTTP_PROXY", "http://proxy:3128")
+	os.Setenv("HTTPS_PROXY", "http://secure-proxy:3128")
+	os.Setenv("NO_PROXY", "localhost")
+
+	httpProxy, httpsProxy, noProxy := engineProxy("auto")
+	assert.Equal(t, "http://proxy:3128", httpProxy)
+	assert.Equal(t, "http://secure-proxy:3128", httpsProxy)
+	assert.Equal(t, "localhost", noProxy)
+
+	httpProxy, httpsProxy, noProxy = engineProxy("http://other:8080")
+	assert.Equal(t, "http://other:8080", httpProxy)
+	assert.Equal(t, "http://other:8080", httpsProxy)
+	assert.Equal(t, "localhost", noProxy)
+
+	httpProxy, httpsProxy, noProxy = engineProxy("none")
+	assert.Equal(t, "", httpProxy+httpsProxy+noProxy)
+}
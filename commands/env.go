@@ -117,8 +117,7 @@ func shellCfgSet(c CommandLine, api libmachine.API) (*ShellConfig, error) {
 		key := host.Driver.GetSSHKeyPath()
 
 		if addr != "" {
-			// always use root@ for socket
-			user = "root"
+			user = podmanSocketUser(host)
 		}
 
 		shellCfg = &ShellConfig{
@@ -139,7 +138,11 @@ func shellCfgSet(c CommandLine, api libmachine.API) (*ShellConfig, error) {
 
 		command := []string{client.BinaryPath}
 		command = append(command, client.BaseArgs...)
-		command = append(command, "--", "sudo", "varlink", "-A", `\'podman varlink \\\$VARLINK_ADDRESS\'`, "bridge")
+		command = append(command, "--")
+		if podmanSocketUser(host) == "root" {
+			command = append(command, "sudo")
+		}
+		command = append(command, "varlink", "-A", `\'podman varlink \\\$VARLINK_ADDRESS\'`, "bridge")
 		bridge := strings.Join(command, " ")
 
 		shellCfg = &ShellConfig{
@@ -0,0 +1,233 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/thelonelyghost/p2box/commands/mcndirs"
+	"github.com/thelonelyghost/p2box/libmachine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+var errNoImageSpecified = errors.New("Error: Expected to get one or more image names as arguments")
+
+// imageUsers maps the names of the cached images to the machines using them.
+func imageUsers(api libmachine.API, b2putils *mcnutils.B2pUtils) (map[string][]string, error) {
+	names, err := api.List()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string][]string{}
+	for _, name := range names {
+		h, err := api.Load(name)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading machine %q: %s", name, err)
+		}
+
+		engineVersion := ""
+		if h.HostOptions != nil {
+			engineVersion = h.HostOptions.EngineVersion
+		}
+
+		for _, image := range b2putils.ImagesUsedBy(h.RawDriver, engineVersion) {
+			users[image] = append(users[image], h.Name)
+		}
+	}
+
+	return users, nil
+}
+
+// formatSize prints a size in bytes in the largest unit it has one of.
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// shortDigestLength is the number of hex digits of the digests shown by
+// default, like image IDs
+const shortDigestLength = 12
+
+func writeImageList(w io.Writer, images []mcnutils.CachedImage, users map[string][]string, noTrunc bool) error {
+	tabWriter := tabwriter.NewWriter(w, 5, 1, 3, ' ', 0)
+
+	fmt.Fprintln(tabWriter, "NAME\tVERSION\tDIGEST\tSIZE\tMACHINES")
+	for _, image := range images {
+		version := image.Version
+		if version == "" {
+			version = "-"
+		}
+
+		digest := "-"
+		if image.Digest != "" {
+			digest = image.Digest
+			if !noTrunc && len(digest) > shortDigestLength {
+				digest = digest[:shortDigestLength]
+			}
+			digest = "sha256:" + digest
+		}
+
+		machines := "-"
+		if len(users[image.Name]) > 0 {
+			machines = strings.Join(users[image.Name], ",")
+		}
+
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", image.Name, version, digest, formatSize(image.Size), machines)
+	}
+
+	return tabWriter.Flush()
+}
+
+func cmdImageLs(c CommandLine, api libmachine.API) error {
+	b2putils := mcnutils.NewB2pUtils(mcndirs.GetBaseDir())
+
+	images, err := b2putils.ListCache()
+	if err != nil {
+		return err
+	}
+
+	users, err := imageUsers(api, b2putils)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("quiet") {
+		for _, image := range images {
+			fmt.Println(image.Name)
+		}
+		return nil
+	}
+
+	return writeImageList(os.Stdout, images, users, c.Bool("no-trunc"))
+}
+
+// isImageLocation reports whether a pull argument is the URL or path of an
+// image, rather than a release tag of the ISO.
+func isImageLocation(arg string) bool {
+	if strings.Contains(arg, "://") || strings.ContainsAny(arg, `/\`) {
+		return true
+	}
+
+	_, err := os.Stat(arg)
+	return err == nil
+}
+
+func cmdImagePull(c CommandLine, api libmachine.API) error {
+	if len(c.Args()) > 1 {
+		return ErrTooManyArguments
+	}
+
+	b2putils := mcnutils.NewB2pUtils(mcndirs.GetBaseDir())
+	arg := c.Args().First()
+
+	switch {
+	case arg == "":
+		return b2putils.UpdateISOCache("")
+	case isImageLocation(arg):
+		_, err := b2putils.CacheBaseImage(arg)
+		return err
+	default:
+		_, err := b2putils.CacheTaggedIso(arg)
+		return err
+	}
+}
+
+func cmdImageRm(c CommandLine, api libmachine.API) error {
+	if len(c.Args()) == 0 {
+		c.ShowHelp()
+		return errNoImageSpecified
+	}
+
+	b2putils := mcnutils.NewB2pUtils(mcndirs.GetBaseDir())
+
+	users, err := imageUsers(api, b2putils)
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, name := range c.Args() {
+		if len(users[name]) > 0 && !c.Bool("force") {
+			errs = append(errs, fmt.Errorf("Image %q is used by %s, remove them first or use --force", name, strings.Join(users[name], ", ")))
+			continue
+		}
+
+		if err := b2putils.RemoveCachedImage(name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Infof("Removed %s", name)
+	}
+
+	if len(errs) > 0 {
+		return consolidateErrs(errs)
+	}
+
+	return nil
+}
+
+func cmdImagePrune(c CommandLine, api libmachine.API) error {
+	b2putils := mcnutils.NewB2pUtils(mcndirs.GetBaseDir())
+
+	images, err := b2putils.ListCache()
+	if err != nil {
+		return err
+	}
+
+	users, err := imageUsers(api, b2putils)
+	if err != nil {
+		return err
+	}
+
+	unused := []mcnutils.CachedImage{}
+	for _, image := range images {
+		if len(users[image.Name]) == 0 {
+			unused = append(unused, image)
+		}
+	}
+
+	if len(unused) == 0 {
+		log.Info("No unused images in the cache")
+		return nil
+	}
+
+	var total int64
+	names := []string{}
+	for _, image := range unused {
+		total += image.Size
+		names = append(names, image.Name)
+	}
+
+	log.Infof("About to remove %s", strings.Join(names, ", "))
+
+	if !userConfirm(false, c.Bool("force")) {
+		return nil
+	}
+
+	for _, image := range unused {
+		if err := b2putils.RemoveCachedImage(image.Name); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Removed %d images, freeing %s", len(unused), formatSize(total))
+
+	return nil
+}
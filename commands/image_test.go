@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thelonelyghost/p2box/commands/commandstest"
+	"github.com/thelonelyghost/p2box/libmachine/libmachinetest"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", formatSize(512))
+	assert.Equal(t, "1.5 KB", formatSize(1536))
+	assert.Equal(t, "45.0 MB", formatSize(45*1024*1024))
+	assert.Equal(t, "2.0 GB", formatSize(2*1024*1024*1024))
+}
+
+func TestWriteImageList(t *testing.T) {
+	images := []mcnutils.CachedImage{
+		{Name: "boot2podman.iso", Version: "v0.19", Digest: strings.Repeat("ab", 32), Size: 45 * 1024 * 1024, ModTime: time.Now()},
+		{Name: "fedora.qcow2", Size: 1024},
+	}
+	users := map[string][]string{
+		"boot2podman.iso": {"box", "dev"},
+	}
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, writeImageList(out, images, users, false))
+
+	assert.Equal(t, "NAME              VERSION   DIGEST                SIZE      MACHINES\n"+
+		"boot2podman.iso   v0.19     sha256:abababababab   45.0 MB   box,dev\n"+
+		"fedora.qcow2      -         -                     1.0 KB    -\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, writeImageList(out, images, users, true))
+
+	assert.Contains(t, out.String(), "sha256:"+strings.Repeat("ab", 32))
+}
+
+func TestIsImageLocation(t *testing.T) {
+	assert.True(t, isImageLocation("https://example.com/fedora.qcow2"))
+	assert.True(t, isImageLocation("/tmp/fedora.qcow2"))
+	assert.False(t, isImageLocation("v0.18"))
+}
+
+func TestCmdImageRmRequiresNames(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{
+		CliArgs: []string{},
+	}
+	api := &libmachinetest.FakeAPI{}
+
+	err := cmdImageRm(commandLine, api)
+
+	assert.Equal(t, errNoImageSpecified, err)
+}
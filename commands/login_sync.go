@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"github.com/thelonelyghost/p2box/libmachine"
+)
+
+func cmdLoginSync(c CommandLine, api libmachine.API) error {
+	if len(c.Args()) > 1 {
+		return ErrExpectedOneMachine
+	}
+
+	target, err := targetHost(c, api)
+	if err != nil {
+		return err
+	}
+
+	host, err := api.Load(target)
+	if err != nil {
+		return err
+	}
+
+	return host.SyncRegistryAuth(c.String("authfile"), c.StringSlice("registry"))
+}
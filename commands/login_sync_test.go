@@ -0,0 +1,29 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/commands/commandstest"
+	"github.com/thelonelyghost/p2box/libmachine/libmachinetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmdLoginSyncMissingMachineName(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{}
+	api := &libmachinetest.FakeAPI{}
+
+	err := cmdLoginSync(commandLine, api)
+
+	assert.Equal(t, ErrNoDefault, err)
+}
+
+func TestCmdLoginSyncTooManyMachines(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{
+		CliArgs: []string{"box", "other"},
+	}
+	api := &libmachinetest.FakeAPI{}
+
+	err := cmdLoginSync(commandLine, api)
+
+	assert.Equal(t, ErrExpectedOneMachine, err)
+}
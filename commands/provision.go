@@ -1,7 +1,47 @@
 package commands
 
-import "github.com/thelonelyghost/p2box/libmachine"
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine"
+	"github.com/thelonelyghost/p2box/libmachine/provision"
+)
 
 func cmdProvision(c CommandLine, api libmachine.API) error {
-	return runAction("provision", c, api)
+	provisionerName := c.String("provisioner")
+	if provisionerName == "" && !c.Bool("dry-run") {
+		return runAction("provision", c, api)
+	}
+
+	if provisionerName != "" && !provision.IsRegistered(provisionerName) {
+		return fmt.Errorf("Unknown provisioner %q, must be one of: %s", provisionerName, strings.Join(provision.Names(), ", "))
+	}
+
+	hosts, err := loadActionHosts(c, api)
+	if err != nil {
+		return err
+	}
+
+	if provisionerName != "" {
+		for _, h := range hosts {
+			h.HostOptions.Provisioner = provisionerName
+		}
+	}
+
+	if c.Bool("dry-run") {
+		// one machine at a time, so the reports do not interleave,
+		// and nothing is saved
+		for _, h := range hosts {
+			fmt.Printf("Machine %q:\n", h.Name)
+			if err := h.ProvisionDryRun(os.Stdout); err != nil {
+				return fmt.Errorf("Error running dry run on %s: %s", h.Name, err)
+			}
+		}
+
+		return nil
+	}
+
+	return runActionOnHosts("provision", hosts, api)
 }
@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/thelonelyghost/p2box/commands/commandstest"
@@ -62,3 +63,18 @@ func TestCmdProvision(t *testing.T) {
 		assert.Equal(t, tc.expectedErr, cmdProvision(tc.commandLine, tc.api))
 	}
 }
+
+func TestCmdProvisionUnknownProvisioner(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{
+		CliArgs: []string{"foo"},
+		LocalFlags: &commandstest.FakeFlagger{
+			Data: map[string]interface{}{
+				"provisioner": "plan9",
+			},
+		},
+	}
+
+	err := cmdProvision(commandLine, &libmachinetest.FakeAPI{})
+
+	assert.EqualError(t, err, `Unknown provisioner "plan9", must be one of: `+strings.Join(provision.Names(), ", "))
+}
@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+// settingsFilename is the file in the storage path holding the defaults of
+// the global flags, for the settings which are the same for every command
+const settingsFilename = "config.json"
+
+// settings are the global flags which can be set in the settings file.
+type settings struct {
+	ReleaseSource string
+	Offline       bool
+	// Proxy is the default of --engine-proxy, also used by the downloads
+	// of the commands without a machine
+	Proxy string
+}
+
+// loadSettings reads the settings file of a storage path, if there is one.
+func loadSettings(storePath string) (*settings, error) {
+	s := &settings{}
+	if storePath == "" {
+		return s, nil
+	}
+
+	settingsPath := filepath.Join(storePath, settingsFilename)
+	content, err := ioutil.ReadFile(settingsPath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, s); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", settingsPath, err)
+	}
+
+	return s, nil
+}
+
+// configureDownloads sets where the ISO releases are downloaded from and
+// through which proxy, the flags taking precedence over the settings file.
+// The driver plugins get them from the environment.
+func configureDownloads(c CommandLine, storePath string) error {
+	s, err := loadSettings(storePath)
+	if err != nil {
+		return err
+	}
+
+	releaseSource := c.GlobalString("release-source")
+	if releaseSource == "" {
+		releaseSource = s.ReleaseSource
+	}
+
+	if err := mcnutils.ParseReleaseSource(releaseSource); err != nil {
+		return err
+	}
+
+	offline := c.GlobalBool("offline") || s.Offline
+
+	mcnutils.ReleaseSource = releaseSource
+	mcnutils.Offline = offline
+	os.Setenv("MACHINE_RELEASE_SOURCE", releaseSource)
+	os.Setenv("MACHINE_OFFLINE", strconv.FormatBool(offline))
+
+	mcnutils.DefaultProxy = s.Proxy
+	if err := mcnutils.ConfigureProxy(""); err != nil {
+		return fmt.Errorf("Error reading the proxy of %s: %s", settingsFilename, err)
+	}
+	os.Setenv("MACHINE_PROXY", s.Proxy)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/commands/commandstest"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureDownloads(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	defer func(source string, offline bool) {
+		mcnutils.ReleaseSource, mcnutils.Offline = source, offline
+		os.Unsetenv("MACHINE_RELEASE_SOURCE")
+		os.Unsetenv("MACHINE_OFFLINE")
+	}(mcnutils.ReleaseSource, mcnutils.Offline)
+
+	ioutil.WriteFile(filepath.Join(storePath, settingsFilename), []byte(`{"ReleaseSource": "/srv/boot2podman", "Offline": true}`), 0644)
+
+	commandLine := &commandstest.FakeCommandLine{
+		GlobalFlags: &commandstest.FakeFlagger{Data: map[string]interface{}{}},
+	}
+
+	assert.NoError(t, configureDownloads(commandLine, storePath))
+	assert.Equal(t, "/srv/boot2podman", mcnutils.ReleaseSource)
+	assert.True(t, mcnutils.Offline)
+	assert.Equal(t, "/srv/boot2podman", os.Getenv("MACHINE_RELEASE_SOURCE"))
+	assert.Equal(t, "true", os.Getenv("MACHINE_OFFLINE"))
+
+	commandLine.GlobalFlags.Data["release-source"] = "http://mirror.internal/boot2podman"
+	assert.NoError(t, configureDownloads(commandLine, storePath))
+	assert.Equal(t, "http://mirror.internal/boot2podman", mcnutils.ReleaseSource)
+
+	commandLine.GlobalFlags.Data["release-source"] = "relative/mirror"
+	assert.Error(t, configureDownloads(commandLine, storePath))
+}
+
+func TestConfigureDownloadsProxy(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	defer func(source string, offline bool, proxy string) {
+		mcnutils.ReleaseSource, mcnutils.Offline, mcnutils.DefaultProxy = source, offline, proxy
+		mcnutils.ConfigureProxy("")
+		os.Unsetenv("MACHINE_RELEASE_SOURCE")
+		os.Unsetenv("MACHINE_OFFLINE")
+		os.Unsetenv("MACHINE_PROXY")
+	}(mcnutils.ReleaseSource, mcnutils.Offline, mcnutils.DefaultProxy)
+
+	commandLine := &commandstest.FakeCommandLine{
+		GlobalFlags: &commandstest.FakeFlagger{Data: map[string]interface{}{}},
+	}
+
+	ioutil.WriteFile(filepath.Join(storePath, settingsFilename), []byte(`{"Proxy": "http://proxy:3128"}`), 0644)
+	assert.NoError(t, configureDownloads(commandLine, storePath))
+	assert.Equal(t, "http://proxy:3128", mcnutils.DefaultProxy)
+	assert.Equal(t, "http://proxy:3128", os.Getenv("MACHINE_PROXY"))
+
+	ioutil.WriteFile(filepath.Join(storePath, settingsFilename), []byte(`{"Proxy": "proxy:3128"}`), 0644)
+	assert.Error(t, configureDownloads(commandLine, storePath))
+}
+
+func TestLoadSettingsWithoutFile(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	s, err := loadSettings(storePath)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &settings{}, s)
+}
@@ -1,7 +1,23 @@
 package commands
 
-import "github.com/thelonelyghost/p2box/libmachine"
+import (
+	"time"
+
+	"github.com/thelonelyghost/p2box/libmachine"
+	"github.com/thelonelyghost/p2box/libmachine/host"
+)
 
 func cmdStop(c CommandLine, api libmachine.API) error {
-	return runAction("stop", c, api)
+	timeout := host.DefaultStopTimeout
+	if c.IsSet("timeout") {
+		timeout = time.Duration(c.Int("timeout")) * time.Second
+	}
+
+	if c.Bool("force") {
+		timeout = 0
+	}
+
+	return runActionFunc(func(h *host.Host) error {
+		return h.StopWithTimeout(timeout)
+	}, c, api)
 }
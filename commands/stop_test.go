@@ -101,3 +101,38 @@ func TestCmdStop(t *testing.T) {
 		}
 	}
 }
+
+// stubbornDriver ignores the requests to shut down, it can only be killed.
+type stubbornDriver struct {
+	fakedriver.Driver
+}
+
+func (d *stubbornDriver) Stop() error {
+	return nil
+}
+
+func TestCmdStopForce(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{
+		CliArgs: []string{"stubborn"},
+		LocalFlags: &commandstest.FakeFlagger{
+			Data: map[string]interface{}{
+				"force": true,
+			},
+		},
+	}
+	api := &libmachinetest.FakeAPI{
+		Hosts: []*host.Host{
+			{
+				Name: "stubborn",
+				Driver: &stubbornDriver{
+					Driver: fakedriver.Driver{MockState: state.Running},
+				},
+			},
+		},
+	}
+
+	err := cmdStop(commandLine, api)
+
+	assert.NoError(t, err)
+	assert.Equal(t, state.Stopped, libmachinetest.State(api, "stubborn"))
+}
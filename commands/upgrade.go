@@ -1,7 +1,29 @@
 package commands
 
-import "github.com/thelonelyghost/p2box/libmachine"
+import (
+	"errors"
+
+	"github.com/thelonelyghost/p2box/libmachine"
+	"github.com/thelonelyghost/p2box/libmachine/host"
+)
+
+var errUpgradeToAndRollback = errors.New("Error: --to and --rollback cannot be used together")
 
 func cmdUpgrade(c CommandLine, api libmachine.API) error {
+	version := c.String("to")
+
+	if c.Bool("rollback") {
+		if version != "" {
+			return errUpgradeToAndRollback
+		}
+		return runActionFunc((*host.Host).Rollback, c, api)
+	}
+
+	if version != "" {
+		return runActionFunc(func(h *host.Host) error {
+			return h.UpgradeTo(version)
+		}, c, api)
+	}
+
 	return runAction("upgrade", c, api)
 }
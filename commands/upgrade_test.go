@@ -0,0 +1,26 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/commands/commandstest"
+	"github.com/thelonelyghost/p2box/libmachine/libmachinetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCmdUpgradeToAndRollback(t *testing.T) {
+	commandLine := &commandstest.FakeCommandLine{
+		CliArgs: []string{"box"},
+		LocalFlags: &commandstest.FakeFlagger{
+			Data: map[string]interface{}{
+				"to":       "v0.18",
+				"rollback": true,
+			},
+		},
+	}
+	api := &libmachinetest.FakeAPI{}
+
+	err := cmdUpgrade(commandLine, api)
+
+	assert.Equal(t, errUpgradeToAndRollback, err)
+}
@@ -0,0 +1,155 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+const defaultArch = "x86_64"
+
+// arch is how QEMU runs the guests of an architecture.
+type arch struct {
+	// program is the qemu-system-* emulating the architecture
+	program string
+	// machine is the machine type, and tcgCPU the CPU model emulated when
+	// the host CPU cannot be used
+	machine string
+	tcgCPU  string
+	// goarch is the GOARCH of the hosts which can run the guests natively
+	goarch string
+	// uefi lists where the UEFI firmware of the architecture may be
+	// installed, and uefiOnly is set when the machine cannot boot without
+	uefi     []uefiFirmware
+	uefiOnly bool
+	// virtioOnly is set when the machine has no IDE controller for -cdrom
+	// and plain disks
+	virtioOnly bool
+}
+
+var archs = map[string]arch{
+	"x86_64": {
+		program: "qemu-system-x86_64",
+		machine: "pc",
+		tcgCPU:  "qemu64",
+		goarch:  "amd64",
+		uefi: []uefiFirmware{
+			{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+			{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+			{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+			{"/usr/share/edk2-ovmf/x64/OVMF_CODE.fd", "/usr/share/edk2-ovmf/x64/OVMF_VARS.fd"},
+			{"/usr/share/qemu/edk2-x86_64-code.fd", "/usr/share/qemu/edk2-i386-vars.fd"},
+			{"/usr/local/share/qemu/edk2-x86_64-code.fd", "/usr/local/share/qemu/edk2-i386-vars.fd"},
+			{"/opt/homebrew/share/qemu/edk2-x86_64-code.fd", "/opt/homebrew/share/qemu/edk2-i386-vars.fd"},
+		},
+	},
+	"aarch64": {
+		program: "qemu-system-aarch64",
+		machine: "virt",
+		tcgCPU:  "cortex-a57",
+		goarch:  "arm64",
+		uefi: []uefiFirmware{
+			{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+			{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+			{"/usr/share/qemu/edk2-aarch64-code.fd", "/usr/share/qemu/edk2-arm-vars.fd"},
+			{"/usr/local/share/qemu/edk2-aarch64-code.fd", "/usr/local/share/qemu/edk2-arm-vars.fd"},
+			{"/opt/homebrew/share/qemu/edk2-aarch64-code.fd", "/opt/homebrew/share/qemu/edk2-arm-vars.fd"},
+		},
+		uefiOnly:   true,
+		virtioOnly: true,
+	},
+	"ppc64le": {
+		program: "qemu-system-ppc64",
+		machine: "pseries",
+		tcgCPU:  "power9",
+		goarch:  "ppc64le",
+	},
+	"s390x": {
+		program:    "qemu-system-s390x",
+		machine:    "s390-ccw-virtio",
+		tcgCPU:     "qemu",
+		goarch:     "s390x",
+		virtioOnly: true,
+	},
+}
+
+func archNames() []string {
+	names := []string{}
+	for name := range archs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// archName returns the architecture of the machine, which is x86_64 for the
+// machines created before it could be chosen.
+func (d *Driver) archName() string {
+	if d.Arch == "" {
+		return defaultArch
+	}
+	return d.Arch
+}
+
+func (d *Driver) getArch() (arch, error) {
+	name := d.archName()
+	a, ok := archs[name]
+	if !ok {
+		return arch{}, fmt.Errorf("Unsupported architecture %q, expected one of %s", name, strings.Join(archNames(), ", "))
+	}
+	return a, nil
+}
+
+// program returns the QEMU program running the machine.
+func (d *Driver) program(a arch) string {
+	if d.Program != "" {
+		return d.Program
+	}
+	return a.program
+}
+
+// accelArgs returns the arguments of the fastest accelerator the host has
+// for the architecture, falling back to TCG emulation.
+func (d *Driver) accelArgs(a arch) []string {
+	native := a.goarch == runtime.GOARCH
+
+	if native && runtime.GOOS == "linux" && kvmUsable() {
+		return []string{"-accel", "kvm", "-cpu", "host"}
+	}
+	if native && runtime.GOOS == "darwin" && hvfUsable() {
+		return []string{"-accel", "hvf", "-cpu", "host"}
+	}
+	if d.HVF {
+		log.Warnf("Ignoring --qemu-hvf, Hypervisor.framework only runs guests of the architecture of a macOS host which supports it")
+	}
+
+	if native {
+		log.Warnf("No hardware acceleration is usable, falling back to emulation (TCG), which is much slower")
+	} else {
+		log.Warnf("No hardware acceleration for %s guests on a %s host, falling back to emulation (TCG), which is much slower", d.archName(), runtime.GOARCH)
+	}
+	return []string{"-accel", "tcg", "-cpu", a.tcgCPU}
+}
+
+// hvfUsable checks that macOS supports Hypervisor.framework, which it does
+// not in most virtual machines, such as CI runners.
+func hvfUsable() bool {
+	out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "1"
+}
+
+// kvmUsable checks that the user can open /dev/kvm, which exists without
+// hardware virtualization and is only writable by the kvm group.
+func kvmUsable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
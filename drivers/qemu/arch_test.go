@@ -0,0 +1,87 @@
+package qemu
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchDefaultsToX86(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+
+	a, err := driver.getArch()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "qemu-system-x86_64", driver.program(a))
+	assert.Equal(t, "pc", a.machine)
+}
+
+func TestArchUnsupported(t *testing.T) {
+	_, err := setConfig(t, map[string]interface{}{
+		"qemu-arch":       "mips",
+		"qemu-base-image": "/images/debian.qcow2",
+	})
+
+	assert.EqualError(t, err, `Unsupported architecture "mips", expected one of aarch64, ppc64le, s390x, x86_64`)
+}
+
+func TestArchNeedsBaseImage(t *testing.T) {
+	_, err := setConfig(t, map[string]interface{}{
+		"qemu-arch": "aarch64",
+	})
+
+	assert.Error(t, err)
+}
+
+func TestArchProgramAndDrives(t *testing.T) {
+	driver, err := setConfig(t, map[string]interface{}{
+		"qemu-arch":       "aarch64",
+		"qemu-base-image": "/images/debian.qcow2",
+	})
+	assert.NoError(t, err)
+
+	a, err := driver.getArch()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "qemu-system-aarch64", driver.program(a))
+	assert.True(t, driver.VirtioDrives)
+
+	driver.Program = "/opt/qemu/bin/qemu-system-aarch64"
+	assert.Equal(t, "/opt/qemu/bin/qemu-system-aarch64", driver.program(a))
+}
+
+func TestAccelFallsBackToTCG(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.Arch = "s390x"
+	if runtime.GOARCH == "s390x" {
+		driver.Arch = "x86_64"
+	}
+
+	a, err := driver.getArch()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"-accel", "tcg", "-cpu", a.tcgCPU}, driver.accelArgs(a))
+}
+
+func TestHVFOnlyForNativeGuests(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.HVF = true
+	driver.Arch = "s390x"
+	if runtime.GOARCH == "s390x" {
+		driver.Arch = "x86_64"
+	}
+
+	a, err := driver.getArch()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"-accel", "tcg", "-cpu", a.tcgCPU}, driver.accelArgs(a))
+}
+
+func TestHVFUnusableOutsideMacOS(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("the host may support Hypervisor.framework")
+	}
+
+	assert.False(t, hvfUsable())
+}
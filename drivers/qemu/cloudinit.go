@@ -0,0 +1,131 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+const (
+	cloudInitDirname  = "cloud-init"
+	cloudInitFilename = "seed.iso"
+	cloudInitVolumeID = "cidata"
+)
+
+func (d *Driver) cloudInitPath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, cloudInitFilename)
+}
+
+// Make a machine disk that uses a cached cloud image as its backing file.
+func (d *Driver) generateOverlayImage(baseImage string, size int) error {
+	log.Debugf("Creating %d MB overlay disk image on %s...", size, baseImage)
+
+	stdout, stderr, err := cmdOutErr("qemu-img", "info", "--output=json", baseImage)
+	if err != nil {
+		fmt.Printf("OUTPUT: %s\n", stdout)
+		fmt.Printf("ERROR: %s\n", stderr)
+		return err
+	}
+	var info struct {
+		Format      string `json:"format"`
+		VirtualSize int64  `json:"virtual-size"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &info); err != nil {
+		return fmt.Errorf("Error reading base image info: %s", err)
+	}
+	if info.Format != "qcow2" && info.Format != "raw" {
+		return fmt.Errorf("Unsupported base image format %q, expected qcow2 or raw", info.Format)
+	}
+
+	if minSize := overlayMinSize(info.VirtualSize); size < minSize {
+		log.Warnf("The disk size of %d MB is smaller than the base image, using its %d MB instead", size, minSize)
+		size = minSize
+	}
+
+	if stdout, stderr, err := cmdOutErr("qemu-img", "create", "-f", "qcow2", "-F", info.Format, "-b", baseImage, d.diskPath(), fmt.Sprintf("%dM", size)); err != nil {
+		fmt.Printf("OUTPUT: %s\n", stdout)
+		fmt.Printf("ERROR: %s\n", stderr)
+		return err
+	}
+	log.Debugf("DONE writing to %s", d.diskPath())
+
+	return nil
+}
+
+// overlayMinSize returns the size in MB of the smallest overlay of a base
+// image of virtualSize bytes, an overlay cannot be smaller than its base.
+func overlayMinSize(virtualSize int64) int {
+	return int((virtualSize + 1<<20 - 1) >> 20)
+}
+
+// Make a cloud-init NoCloud seed image, so that the cloud image sets up the
+// SSH user and the hostname on first boot.
+func (d *Driver) generateCloudInitSeed() error {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	seedDir := filepath.Join(machineDir, cloudInitDirname)
+	if err := os.MkdirAll(seedDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(seedDir)
+
+	userData := fmt.Sprintf(`#cloud-config
+hostname: %s
+users:
+  - name: %s
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - %s
+`, d.GetMachineName(), d.GetSSHUsername(), strings.TrimSpace(string(pubKey)))
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", d.GetMachineName(), d.GetMachineName())
+
+	if err := ioutil.WriteFile(filepath.Join(seedDir, "user-data"), []byte(userData), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(seedDir, "meta-data"), []byte(metaData), 0644); err != nil {
+		return err
+	}
+
+	program, args, err := isoCommand(seedDir, d.cloudInitPath())
+	if err != nil {
+		return err
+	}
+	if stdout, stderr, err := cmdOutErr(program, args...); err != nil {
+		fmt.Printf("OUTPUT: %s\n", stdout)
+		fmt.Printf("ERROR: %s\n", stderr)
+		return err
+	}
+
+	return nil
+}
+
+// isoCommand returns the command line of the first available tool that can
+// pack the files in dir into an ISO image labeled for cloud-init.
+func isoCommand(dir, isoPath string) (string, []string, error) {
+	files := []string{filepath.Join(dir, "user-data"), filepath.Join(dir, "meta-data")}
+
+	for _, program := range []string{"genisoimage", "mkisofs", "xorrisofs"} {
+		if _, err := exec.LookPath(program); err == nil {
+			args := []string{"-output", isoPath, "-volid", cloudInitVolumeID, "-joliet", "-rock"}
+			return program, append(args, files...), nil
+		}
+	}
+
+	if _, err := exec.LookPath("hdiutil"); err == nil {
+		return "hdiutil", []string{"makehybrid", "-iso", "-joliet", "-default-volume-name", cloudInitVolumeID, "-o", isoPath, dir}, nil
+	}
+
+	return "", nil, fmt.Errorf("Unable to create the cloud-init image: none of genisoimage, mkisofs, xorrisofs or hdiutil was found")
+}
@@ -0,0 +1,14 @@
+package qemu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayMinSize(t *testing.T) {
+	assert.Equal(t, 0, overlayMinSize(0))
+	assert.Equal(t, 2252, overlayMinSize(2361393152))
+	assert.Equal(t, 2253, overlayMinSize(2361393152+1))
+	assert.Equal(t, 10240, overlayMinSize(10*1024*1024*1024))
+}
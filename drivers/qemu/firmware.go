@@ -0,0 +1,127 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+const (
+	firmwareBIOS = "bios"
+	firmwareUEFI = "uefi"
+
+	// firmwareVarsFilename is the copy of the UEFI variables of a machine,
+	// its NVRAM, in the machine directory
+	firmwareVarsFilename = "efivars.fd"
+)
+
+// uefiFirmware is a UEFI firmware, whose code is shared by the machines and
+// whose variables are a template copied for each machine.
+type uefiFirmware struct {
+	code string
+	vars string
+}
+
+// firmware returns the firmware of the machine, UEFI for the architectures
+// which cannot boot without and the BIOS of QEMU otherwise.
+func (d *Driver) firmware(a arch) string {
+	if d.Firmware != "" {
+		return d.Firmware
+	}
+	if a.uefiOnly {
+		return firmwareUEFI
+	}
+	return firmwareBIOS
+}
+
+func (d *Driver) checkFirmware(a arch) error {
+	switch d.firmware(a) {
+	case firmwareBIOS:
+		if a.uefiOnly {
+			return fmt.Errorf("%s machines need --qemu-firmware %s", d.archName(), firmwareUEFI)
+		}
+		if d.FirmwareCode != "" || d.FirmwareVars != "" {
+			return fmt.Errorf("--qemu-firmware-code and --qemu-firmware-vars need --qemu-firmware %s", firmwareUEFI)
+		}
+	case firmwareUEFI:
+		if (d.FirmwareCode == "") != (d.FirmwareVars == "") {
+			return fmt.Errorf("--qemu-firmware-code and --qemu-firmware-vars must be used together")
+		}
+		if d.FirmwareCode == "" && len(a.uefi) == 0 {
+			return fmt.Errorf("No UEFI firmware is known for %s machines, pass its --qemu-firmware-code and --qemu-firmware-vars", d.archName())
+		}
+	default:
+		return fmt.Errorf("Invalid firmware %q, expected %s or %s", d.Firmware, firmwareBIOS, firmwareUEFI)
+	}
+
+	return nil
+}
+
+// locateUEFI returns the first UEFI firmware installed.
+func locateUEFI(candidates []uefiFirmware) (uefiFirmware, error) {
+	searched := []string{}
+	for _, firmware := range candidates {
+		_, codeErr := os.Stat(firmware.code)
+		_, varsErr := os.Stat(firmware.vars)
+		if codeErr == nil && varsErr == nil {
+			return firmware, nil
+		}
+		searched = append(searched, firmware.code)
+	}
+
+	return uefiFirmware{}, fmt.Errorf("No UEFI firmware found, install the OVMF (or AAVMF, edk2) package of your distribution or pass its --qemu-firmware-code and --qemu-firmware-vars, looked for %s", strings.Join(searched, ", "))
+}
+
+// setupFirmware locates the UEFI firmware of the machine, and gives it its own
+// copy of the UEFI variables, unless it has one already.
+func (d *Driver) setupFirmware(a arch) error {
+	if d.firmware(a) != firmwareUEFI {
+		return nil
+	}
+
+	if d.FirmwareCode == "" {
+		firmware, err := locateUEFI(a.uefi)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Using the UEFI firmware %s", firmware.code)
+		d.FirmwareCode, d.FirmwareVars = firmware.code, firmware.vars
+	}
+
+	if _, err := os.Stat(d.FirmwareCode); err != nil {
+		return fmt.Errorf("Error reading the UEFI firmware: %s", err)
+	}
+
+	if _, err := os.Stat(d.firmwareVarsPath()); os.IsNotExist(err) {
+		log.Infof("Creating UEFI variables...")
+		if err := mcnutils.CopyFile(d.FirmwareVars, d.firmwareVarsPath()); err != nil {
+			return fmt.Errorf("Error copying the UEFI variables: %s", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// firmwareArgs returns the QEMU arguments of the firmware, none for the BIOS
+// which comes with QEMU.
+func (d *Driver) firmwareArgs(a arch) []string {
+	if d.firmware(a) != firmwareUEFI {
+		return nil
+	}
+
+	return []string{
+		"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", escapeOptionValue(d.FirmwareCode)),
+		"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", escapeOptionValue(d.firmwareVarsPath())),
+	}
+}
+
+func (d *Driver) firmwareVarsPath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, firmwareVarsFilename)
+}
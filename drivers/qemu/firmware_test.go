@@ -0,0 +1,99 @@
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirmwareDefaults(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+
+	assert.Equal(t, firmwareBIOS, driver.firmware(archs["x86_64"]))
+	assert.Equal(t, firmwareUEFI, driver.firmware(archs["aarch64"]))
+	assert.Empty(t, driver.firmwareArgs(archs["x86_64"]))
+}
+
+func TestCheckFirmware(t *testing.T) {
+	testCases := []struct {
+		values map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"qemu-firmware": "uefi"}, ""},
+		{map[string]interface{}{"qemu-firmware": "coreboot"}, `Invalid firmware "coreboot", expected bios or uefi`},
+		{map[string]interface{}{"qemu-firmware-code": "/OVMF_CODE.fd", "qemu-firmware-vars": "/OVMF_VARS.fd"}, "--qemu-firmware-code and --qemu-firmware-vars need --qemu-firmware uefi"},
+		{map[string]interface{}{"qemu-firmware": "uefi", "qemu-firmware-code": "/OVMF_CODE.fd"}, "--qemu-firmware-code and --qemu-firmware-vars must be used together"},
+		{map[string]interface{}{"qemu-arch": "aarch64", "qemu-base-image": "/debian.qcow2", "qemu-firmware": "bios"}, "aarch64 machines need --qemu-firmware uefi"},
+		{map[string]interface{}{"qemu-arch": "s390x", "qemu-base-image": "/debian.qcow2", "qemu-firmware": "uefi"}, "No UEFI firmware is known for s390x machines, pass its --qemu-firmware-code and --qemu-firmware-vars"},
+	}
+
+	for _, tc := range testCases {
+		_, err := setConfig(t, tc.values)
+
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+}
+
+func TestSetupFirmware(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	machineDir := filepath.Join(storePath, "machines", "default")
+	if err := os.MkdirAll(machineDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	code := filepath.Join(storePath, "OVMF_CODE.fd")
+	vars := filepath.Join(storePath, "OVMF_VARS.fd")
+	assert.NoError(t, ioutil.WriteFile(code, []byte("code"), 0644))
+	assert.NoError(t, ioutil.WriteFile(vars, []byte("vars"), 0644))
+
+	a := archs["x86_64"]
+	a.uefi = []uefiFirmware{
+		{filepath.Join(storePath, "missing", "OVMF_CODE.fd"), filepath.Join(storePath, "missing", "OVMF_VARS.fd")},
+		{code, vars},
+	}
+
+	driver := NewDriver("default", storePath).(*Driver)
+	driver.Firmware = firmwareUEFI
+
+	assert.NoError(t, driver.setupFirmware(a))
+	assert.Equal(t, code, driver.FirmwareCode)
+
+	copied, err := ioutil.ReadFile(filepath.Join(machineDir, firmwareVarsFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, "vars", string(copied))
+
+	// the variables of the machine are kept
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(machineDir, firmwareVarsFilename), []byte("boot order"), 0644))
+	assert.NoError(t, driver.setupFirmware(a))
+
+	copied, err = ioutil.ReadFile(filepath.Join(machineDir, firmwareVarsFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, "boot order", string(copied))
+
+	assert.Equal(t, []string{
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + code,
+		"-drive", "if=pflash,format=raw,unit=1,file=" + filepath.Join(machineDir, firmwareVarsFilename),
+	}, driver.firmwareArgs(a))
+}
+
+func TestSetupFirmwareNotFound(t *testing.T) {
+	driver := NewDriver("default", "path").(*Driver)
+	driver.Firmware = firmwareUEFI
+
+	a := archs["x86_64"]
+	a.uefi = []uefiFirmware{{"/missing/OVMF_CODE.fd", "/missing/OVMF_VARS.fd"}}
+
+	assert.Error(t, driver.setupFirmware(a))
+}
@@ -0,0 +1,107 @@
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ignitionFilename = "ignition.json"
+	ignitionVersion  = "3.1.0"
+
+	// ignitionFwCfgName is where Fedora CoreOS looks for its config
+	// when running on QEMU
+	ignitionFwCfgName = "opt/com.coreos/config"
+)
+
+// The subset of the Ignition config specification used for machines.
+// See https://coreos.github.io/ignition/configuration-v3_1/
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  ignitionPasswd  `json:"passwd"`
+	Storage ignitionStorage `json:"storage"`
+	Systemd ignitionSystemd `json:"systemd"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	Groups            []string `json:"groups,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files"`
+}
+
+type ignitionFile struct {
+	Path     string               `json:"path"`
+	Mode     int                  `json:"mode"`
+	Contents ignitionFileContents `json:"contents"`
+}
+
+type ignitionFileContents struct {
+	Source string `json:"source"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units"`
+}
+
+type ignitionUnit struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+func (d *Driver) ignitionPath() string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, ignitionFilename)
+}
+
+// Make an Ignition config which sets up the SSH user, the hostname and the
+// Podman socket on the first boot of a Fedora CoreOS image.
+func (d *Driver) generateIgnitionConfig() error {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	var config ignitionConfig
+	config.Ignition.Version = ignitionVersion
+	config.Passwd.Users = []ignitionUser{
+		{
+			Name: d.GetSSHUsername(),
+			// members of "sudo" get passwordless sudo on Fedora CoreOS
+			Groups:            []string{"sudo"},
+			SSHAuthorizedKeys: []string{strings.TrimSpace(string(pubKey))},
+		},
+	}
+	config.Storage.Files = []ignitionFile{
+		{
+			Path: "/etc/hostname",
+			Mode: 0644,
+			Contents: ignitionFileContents{
+				Source: fmt.Sprintf("data:,%s", url.PathEscape(d.GetMachineName())),
+			},
+		},
+	}
+	config.Systemd.Units = []ignitionUnit{
+		{Name: "podman.socket", Enabled: true},
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(d.ignitionPath(), data, 0600)
+}
@@ -3,7 +3,6 @@ package qemu
 import (
 	"archive/tar"
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -16,6 +15,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/thelonelyghost/p2box/drivers/qemu/qmp"
 	"github.com/thelonelyghost/p2box/libmachine/drivers"
 	"github.com/thelonelyghost/p2box/libmachine/log"
 	"github.com/thelonelyghost/p2box/libmachine/mcnflag"
@@ -29,8 +29,14 @@ const (
 	privateNetworkName = "podman-machines"
 
 	defaultSSHUser = "tc"
+
+	// qmpTimeout bounds the connection to the monitor and its commands
+	qmpTimeout = 30 * time.Second
 )
 
+// killTimeout bounds the wait for QEMU to quit before it is sent SIGKILL
+var killTimeout = 5 * time.Second
+
 type Driver struct {
 	*drivers.BaseDriver
 	EnginePort int
@@ -40,6 +46,10 @@ type Driver struct {
 	DiskSize         int
 	CPU              int
 	Program          string
+	Arch             string
+	Firmware         string
+	FirmwareCode     string
+	FirmwareVars     string
 	Display          bool
 	DisplayType      string
 	NetVlan          bool
@@ -49,6 +59,8 @@ type Driver struct {
 	Network          string
 	PrivateNetwork   string
 	Boot2PodmanURL   string
+	BaseImage        string
+	Ignition         bool
 	NetworkInterface string
 	NetworkAddress   string
 	NetworkBridge    string
@@ -64,6 +76,13 @@ type Driver struct {
 	UserDataFile    string
 	CloudConfigRoot string
 	LocalPorts      string
+
+	// Boot2PodmanChecksum is the sha256:DIGEST the ISO is verified against
+	Boot2PodmanChecksum string
+
+	// ShareFolders are the HOST[:GUEST] directories mounted in the guest
+	ShareFolders []string
+	NoShare      bool
 }
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -83,10 +102,30 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage: "Number of CPUs",
 			Value: 1,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_ARCH",
+			Name:   "qemu-arch",
+			Usage:  fmt.Sprintf("Architecture of the machine: %s", strings.Join(archNames(), ", ")),
+			Value:  defaultArch,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_FIRMWARE",
+			Name:   "qemu-firmware",
+			Usage:  "Firmware of the machine: bios or uefi. Defaults to uefi for aarch64 and bios otherwise",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_FIRMWARE_CODE",
+			Name:   "qemu-firmware-code",
+			Usage:  "Path of the UEFI firmware code (such as OVMF_CODE.fd). Defaults to the one installed",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_FIRMWARE_VARS",
+			Name:   "qemu-firmware-vars",
+			Usage:  "Path of the UEFI variables template (such as OVMF_VARS.fd) going with --qemu-firmware-code",
+		},
 		mcnflag.StringFlag{
 			Name:  "qemu-program",
-			Usage: "Name of program to run",
-			Value: "qemu-system-x86_64",
+			Usage: "Name of program to run. Defaults to the qemu-system-* of the architecture",
 		},
 		mcnflag.BoolFlag{
 			Name:  "qemu-display",
@@ -112,7 +151,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.BoolFlag{
 			Name:  "qemu-hvf",
-			Usage: "Use the macOS Hypervisor.framework",
+			Usage: "Use the macOS Hypervisor.framework, which is the default on macOS for a machine of the architecture of the host",
 		},
 		mcnflag.StringFlag{
 			Name:  "qemu-network",
@@ -125,6 +164,22 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "The URL of the boot2podman image. Defaults to the latest available version",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_BOOT2PODMAN_CHECKSUM",
+			Name:   "qemu-boot2podman-checksum",
+			Usage:  "The sha256:DIGEST checksum the boot2podman image must have",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "QEMU_BASE_IMAGE",
+			Name:   "qemu-base-image",
+			Usage:  "The URL or path of a qcow2 or raw cloud image to boot instead of the boot2podman ISO",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:  "qemu-ignition",
+			Usage: "Configure the base image with an Ignition config instead of cloud-init (for Fedora CoreOS)",
+		},
 		mcnflag.StringFlag{
 			Name:  "qemu-network-interface",
 			Usage: "Name of the network interface to be used for networking (for tap)",
@@ -160,12 +215,16 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "qemu-localports",
 			Usage:  "Port range to bind local SSH and engine ports",
 		},
-		/* Not yet implemented
-		mcnflag.Flag{
-			Name:  "qemu-no-share",
-			Usage: "Disable the mount of your home directory",
+		mcnflag.StringSliceFlag{
+			EnvVar: "QEMU_SHARE_FOLDER",
+			Name:   "qemu-share-folder",
+			Usage:  "Mount the specified directory in the machine instead of your home directory. Format: host-dir[:guest-dir]",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "QEMU_NO_SHARE",
+			Name:   "qemu-no-share",
+			Usage:  "Disable the mount of your home directory",
 		},
-		*/
 	}
 }
 
@@ -208,6 +267,10 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.DiskSize = flags.Int("qemu-disk-size")
 	d.CPU = flags.Int("qemu-cpu-count")
 	d.Program = flags.String("qemu-program")
+	d.Arch = flags.String("qemu-arch")
+	d.Firmware = flags.String("qemu-firmware")
+	d.FirmwareCode = flags.String("qemu-firmware-code")
+	d.FirmwareVars = flags.String("qemu-firmware-vars")
 	d.Display = flags.Bool("qemu-display")
 	d.DisplayType = flags.String("qemu-display-type")
 	d.NetVlan = flags.Bool("qemu-net-vlan")
@@ -216,17 +279,61 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.HVF = flags.Bool("qemu-hvf")
 	d.Network = flags.String("qemu-network")
 	d.Boot2PodmanURL = flags.String("qemu-boot2podman-url")
+	d.Boot2PodmanChecksum = flags.String("qemu-boot2podman-checksum")
+	d.BaseImage = flags.String("qemu-base-image")
+	d.Ignition = flags.Bool("qemu-ignition")
 	d.NetworkInterface = flags.String("qemu-network-interface")
 	d.NetworkAddress = flags.String("qemu-network-address")
 	d.NetworkBridge = flags.String("qemu-network-bridge")
 	d.CacheMode = flags.String("qemu-cache-mode")
 	d.IOMode = flags.String("qemu-io-mode")
+	d.NoShare = flags.Bool("qemu-no-share")
 
 	d.SSHUser = flags.String("qemu-ssh-user")
 	d.LocalPorts = flags.String("qemu-localports")
 	d.FirstQuery = true
 	d.SSHPort = 22
 	d.DiskPath = d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
+
+	a, err := d.getArch()
+	if err != nil {
+		return err
+	}
+
+	if d.archName() != defaultArch && d.BaseImage == "" {
+		return fmt.Errorf("The boot2podman ISO only runs on %s, a %s machine needs a --qemu-base-image", defaultArch, d.archName())
+	}
+
+	// the cdrom and the disk cannot be attached otherwise
+	if a.virtioOnly {
+		d.VirtioDrives = true
+	}
+
+	if err := d.checkFirmware(a); err != nil {
+		return err
+	}
+
+	if d.Ignition && d.BaseImage == "" {
+		return fmt.Errorf("--qemu-ignition requires a --qemu-base-image")
+	}
+
+	if err := d.setShareFolders(flags.StringSlice("qemu-share-folder")); err != nil {
+		return err
+	}
+
+	if d.Boot2PodmanChecksum != "" {
+		if d.BaseImage != "" {
+			return fmt.Errorf("--qemu-boot2podman-checksum cannot be used with a --qemu-base-image")
+		}
+		if _, err := mcnutils.ParseChecksum(d.Boot2PodmanChecksum); err != nil {
+			return err
+		}
+	}
+
+	// the driver downloads the ISO or image in its own process
+	if err := mcnutils.ConfigureProxy(flags.String("engine-proxy")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -272,34 +379,48 @@ func checkPid(pid int) error {
 	return process.Signal(syscall.Signal(0))
 }
 
-func (d *Driver) GetState() (state.State, error) {
-
-	if _, err := os.Stat(d.pidfilePath()); err != nil {
-		return state.Stopped, nil
-	}
+// readPid returns the pid of the QEMU process of the machine, or 0 when it
+// has none.
+func (d *Driver) readPid() (int, error) {
 	p, err := ioutil.ReadFile(d.pidfilePath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
 	if err != nil {
-		return state.Error, err
+		return 0, err
 	}
 	pid, err := strconv.Atoi(strings.TrimSpace(string(p)))
 	if err != nil {
-		return state.Error, err
+		return 0, err
 	}
 	if err := checkPid(pid); err != nil {
 		// No pid, remove pidfile
 		os.Remove(d.pidfilePath())
-		return state.Stopped, nil
+		return 0, nil
 	}
-	ret, err := d.RunQMPCommand("query-status")
+	return pid, nil
+}
+
+func (d *Driver) GetState() (state.State, error) {
+	pid, err := d.readPid()
 	if err != nil {
 		return state.Error, err
 	}
+	if pid == 0 {
+		return state.Stopped, nil
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := d.runQMP("query-status", nil, &status); err != nil {
+		return state.Error, err
+	}
 	// RunState is one of:
 	// 'debug', 'inmigrate', 'internal-error', 'io-error', 'paused',
 	// 'postmigrate', 'prelaunch', 'finish-migrate', 'restore-vm',
 	// 'running', 'save-vm', 'shutdown', 'suspended', 'watchdog',
 	// 'guest-panicked'
-	switch ret["status"] {
+	switch status.Status {
 	case "running":
 		return state.Running, nil
 	case "paused":
@@ -338,19 +459,63 @@ func (d *Driver) Create() error {
 			break
 		}
 	}
-	b2putils := mcnutils.NewB2pUtils(d.StorePath)
-	if err := b2putils.CopyIsoToMachineDir(d.Boot2PodmanURL, d.MachineName); err != nil {
+
+	a, err := d.getArch()
+	if err != nil {
 		return err
 	}
-
-	log.Infof("Creating SSH key...")
-	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
+	if err := d.setupFirmware(a); err != nil {
 		return err
 	}
 
-	log.Infof("Creating Disk image...")
-	if err := d.generateDiskImage(d.DiskSize); err != nil {
-		return err
+	b2putils := mcnutils.NewB2pUtils(d.StorePath)
+	if d.BaseImage != "" {
+		baseImage, err := b2putils.CacheBaseImage(d.BaseImage)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Creating SSH key...")
+		if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
+			return err
+		}
+
+		log.Infof("Creating Disk image...")
+		if err := d.generateOverlayImage(baseImage, d.DiskSize); err != nil {
+			return err
+		}
+
+		if d.Ignition {
+			log.Infof("Creating Ignition config...")
+			if err := d.generateIgnitionConfig(); err != nil {
+				return err
+			}
+		} else {
+			log.Infof("Creating cloud-init image...")
+			if err := d.generateCloudInitSeed(); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := b2putils.CopyIsoToMachineDir(d.Boot2PodmanURL, d.MachineName); err != nil {
+			return err
+		}
+
+		if d.Boot2PodmanChecksum != "" {
+			if err := b2putils.VerifyMachineIso(d.MachineName, d.Boot2PodmanChecksum); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("Creating SSH key...")
+		if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
+			return err
+		}
+
+		log.Infof("Creating Disk image...")
+		if err := d.generateDiskImage(d.DiskSize); err != nil {
+			return err
+		}
 	}
 
 	log.Infof("Starting QEMU VM...")
@@ -427,7 +592,17 @@ func (d *Driver) Start() error {
 	// fmt.Printf("Init qemu %s\n", i.VM)
 	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
 
-	var startCmd []string
+	a, err := d.getArch()
+	if err != nil {
+		return err
+	}
+
+	startCmd := []string{"-machine", a.machine}
+
+	if err := d.setupFirmware(a); err != nil {
+		return err
+	}
+	startCmd = append(startCmd, d.firmwareArgs(a)...)
 
 	if d.Display {
 		if d.DisplayType != "" {
@@ -451,10 +626,18 @@ func (d *Driver) Start() error {
 
 	startCmd = append(startCmd,
 		"-m", fmt.Sprintf("%d", d.Memory),
-		"-smp", fmt.Sprintf("%d", d.CPU),
-		"-boot", "d")
+		"-smp", fmt.Sprintf("%d", d.CPU))
 	var isoPath = filepath.Join(machineDir, isoFilename)
-	if d.VirtioDrives {
+	if d.BaseImage != "" {
+		// boot from the disk, the cdrom only carries the cloud-init data
+		isoPath = d.cloudInitPath()
+	} else {
+		startCmd = append(startCmd, "-boot", "d")
+	}
+	if d.Ignition {
+		startCmd = append(startCmd,
+			"-fw_cfg", fmt.Sprintf("name=%s,file=%s", ignitionFwCfgName, d.ignitionPath()))
+	} else if d.VirtioDrives {
 		startCmd = append(startCmd,
 			"-drive", fmt.Sprintf("file=%s,index=2,media=cdrom,if=virtio", isoPath))
 	} else {
@@ -508,16 +691,7 @@ func (d *Driver) Start() error {
 
 	startCmd = append(startCmd, "-daemonize")
 
-	if d.HVF {
-		startCmd = append(startCmd, "-accel", "hvf")
-		startCmd = append(startCmd, "-cpu", "host")
-	}
-
-	// other options
-	// "-enable-kvm" if its available
-	if _, err := os.Stat("/dev/kvm"); err == nil {
-		startCmd = append(startCmd, "-enable-kvm")
-	}
+	startCmd = append(startCmd, d.accelArgs(a)...)
 
 	if d.CloudConfigRoot != "" {
 		startCmd = append(startCmd,
@@ -526,6 +700,12 @@ func (d *Driver) Start() error {
 		startCmd = append(startCmd, "-device", "virtio-9p-pci,id=fs0,fsdev=fsdev0,mount_tag=config-2")
 	}
 
+	shares, err := d.startShares()
+	if err != nil {
+		return err
+	}
+	startCmd = append(startCmd, d.shareArgs(shares)...)
+
 	if d.VirtioDrives {
 		startCmd = append(startCmd,
 			"-drive", fmt.Sprintf("file=%s,index=0,media=disk,if=virtio", d.diskPath()))
@@ -534,17 +714,22 @@ func (d *Driver) Start() error {
 		startCmd = append(startCmd, d.diskPath())
 	}
 
-	if stdout, stderr, err := cmdOutErr(d.Program, startCmd...); err != nil {
+	if stdout, stderr, err := cmdOutErr(d.program(a), startCmd...); err != nil {
 		fmt.Printf("OUTPUT: %s\n", stdout)
 		fmt.Printf("ERROR: %s\n", stderr)
+		stopShares(shares)
 		return err
-		//if err := cmdStart(d.Program, startCmd...); err != nil {
+		//if err := cmdStart(d.program(a), startCmd...); err != nil {
 		//	return err
 	}
 	log.Infof("Waiting for VM to start (ssh -p %d %s@localhost)...", d.SSHPort, d.GetSSHUsername())
 
 	//return ssh.WaitForTCP(fmt.Sprintf("localhost:%d", d.SSHPort))
-	return WaitForTCPWithDelay(fmt.Sprintf("localhost:%d", d.SSHPort), time.Second)
+	if err := WaitForTCPWithDelay(fmt.Sprintf("localhost:%d", d.SSHPort), time.Second); err != nil {
+		return err
+	}
+
+	return d.mountShares(shares)
 }
 
 func cmdOutErr(cmdStr string, args ...string) (string, string, error) {
@@ -579,29 +764,17 @@ func cmdStart(cmdStr string, args ...string) error {
 }
 
 func (d *Driver) Stop() error {
-	// _, err := d.RunQMPCommand("stop")
-	_, err := d.RunQMPCommand("system_powerdown")
-	if err != nil {
-		return err
-	}
-	return nil
+	return d.runQMP("system_powerdown", nil, nil)
 }
 
 func (d *Driver) Remove() error {
 	s, err := d.GetState()
 	if err != nil {
-		return err
-	}
-	if s == state.Running {
-		if err := d.Kill(); err != nil {
-			return err
-		}
+		// a machine whose monitor does not answer is killed all the same
+		log.Debugf("Error getting the state of %s: %s", d.GetMachineName(), err)
 	}
 	if s != state.Stopped {
-		_, err = d.RunQMPCommand("quit")
-		if err != nil {
-			return err
-		}
+		return d.Kill()
 	}
 	return nil
 }
@@ -616,16 +789,55 @@ func (d *Driver) Restart() error {
 		if err := d.Stop(); err != nil {
 			return err
 		}
+		if err := mcnutils.WaitFor(drivers.MachineInState(d, state.Stopped)); err != nil {
+			log.Warnf("%s did not shut down, killing it", d.GetMachineName())
+			if err := d.Kill(); err != nil {
+				return err
+			}
+		}
 	}
 	return d.Start()
 }
 
+// Kill asks QEMU to quit without shutting the guest down, then sends it
+// SIGKILL if it did not quit within killTimeout, or if its monitor does not
+// answer at all.
 func (d *Driver) Kill() error {
-	// _, err := d.RunQMPCommand("quit")
-	_, err := d.RunQMPCommand("system_powerdown")
+	pid, err := d.readPid()
+	if err != nil {
+		return err
+	}
+	if pid == 0 {
+		return nil
+	}
+
+	client, err := qmp.Dial("unix", d.monitorPath(), killTimeout)
+	if err == nil {
+		// QEMU may close the monitor before it replies
+		if err := client.Run("quit", nil, nil); err != nil && err != qmp.ErrClosed {
+			log.Debugf("Error asking QEMU to quit: %s", err)
+		}
+		client.Close()
+
+		if err := mcnutils.WaitForSpecific(func() bool {
+			return checkPid(pid) != nil
+		}, int(killTimeout/(100*time.Millisecond)), 100*time.Millisecond); err == nil {
+			os.Remove(d.pidfilePath())
+			return nil
+		}
+	} else {
+		log.Debugf("Error connecting to the monitor of %s: %s", d.GetMachineName(), err)
+	}
+
+	log.Infof("Sending SIGKILL to QEMU (pid %d)...", pid)
+	process, err := os.FindProcess(pid)
 	if err != nil {
 		return err
 	}
+	if err := process.Signal(syscall.SIGKILL); err != nil && checkPid(pid) == nil {
+		return fmt.Errorf("Error killing QEMU (pid %d): %s", pid, err)
+	}
+	os.Remove(d.pidfilePath())
 	return nil
 }
 
@@ -723,93 +935,16 @@ func (d *Driver) generateDiskImage(size int) error {
 	return nil
 }
 
-func (d *Driver) RunQMPCommand(command string) (map[string]interface{}, error) {
-
-	// connect to monitor
-	conn, err := net.Dial("unix", d.monitorPath())
+// runQMP runs a command on the monitor of the machine, decoding its result
+// into result unless nil.
+func (d *Driver) runQMP(command string, arguments, result interface{}) error {
+	client, err := qmp.Dial("unix", d.monitorPath(), qmpTimeout)
 	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	// initial QMP response
-	var buf [1024]byte
-	nr, err := conn.Read(buf[:])
-	if err != nil {
-		return nil, err
-	}
-	type qmpInitialResponse struct {
-		QMP struct {
-			Version struct {
-				QEMU struct {
-					Micro int `json:"micro"`
-					Minor int `json:"minor"`
-					Major int `json:"major"`
-				} `json:"qemu"`
-				Package string `json:"package"`
-			} `json:"version"`
-			Capabilities []string `json:"capabilities"`
-		} `jason:"QMP"`
-	}
-
-	var initialResponse qmpInitialResponse
-	json.Unmarshal(buf[:nr], &initialResponse)
-
-	// run 'qmp_capabilities' to switch to command mode
-	// { "execute": "qmp_capabilities" }
-	type qmpCommand struct {
-		Command string `json:"execute"`
-	}
-	jsonCommand, err := json.Marshal(qmpCommand{Command: "qmp_capabilities"})
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write(jsonCommand)
-	if err != nil {
-		return nil, err
-	}
-	nr, err = conn.Read(buf[:])
-	if err != nil {
-		return nil, err
-	}
-	type qmpResponse struct {
-		Return map[string]interface{} `json:"return"`
-	}
-	var response qmpResponse
-	err = json.Unmarshal(buf[:nr], &response)
-	if err != nil {
-		return nil, err
-	}
-	// expecting empty response
-	if len(response.Return) != 0 {
-		return nil, fmt.Errorf("qmp_capabilities failed: %v", response.Return)
+		return err
 	}
+	defer client.Close()
 
-	// { "execute": command }
-	jsonCommand, err = json.Marshal(qmpCommand{Command: command})
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write(jsonCommand)
-	if err != nil {
-		return nil, err
-	}
-	nr, err = conn.Read(buf[:])
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(buf[:nr], &response)
-	if err != nil {
-		return nil, err
-	}
-	if strings.HasPrefix(command, "query-") {
-		return response.Return, nil
-	}
-	// non-query commands should return an empty response
-	if len(response.Return) != 0 {
-		return nil, fmt.Errorf("%s failed: %v", command, response.Return)
-	}
-	return response.Return, nil
+	return client.Run(command, arguments, result)
 }
 
 func WaitForTCPWithDelay(addr string, duration time.Duration) error {
@@ -0,0 +1,100 @@
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/thelonelyghost/p2box/drivers/qemu/qmp/qmptest"
+	"github.com/thelonelyghost/p2box/libmachine/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// newKillableDriver returns a driver whose QEMU process is a sleep, which
+// neither quits nor shuts down.
+func newKillableDriver(t *testing.T) (*Driver, *exec.Cmd) {
+	storePath, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDriver("default", storePath).(*Driver)
+	if err := os.MkdirAll(filepath.Join(storePath, "machines", "default"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(d.pidfilePath(), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return d, cmd
+}
+
+func assertKilled(t *testing.T, cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	if assert.Error(t, err) {
+		status := err.(*exec.ExitError).Sys().(syscall.WaitStatus)
+		assert.Equal(t, syscall.SIGKILL, status.Signal())
+	}
+}
+
+func TestKillQuitsThenSendsSIGKILL(t *testing.T) {
+	defer func(timeout time.Duration) { killTimeout = timeout }(killTimeout)
+	killTimeout = 200 * time.Millisecond
+
+	d, cmd := newKillableDriver(t)
+	defer os.RemoveAll(d.StorePath)
+
+	server, err := qmptest.NewServer("unix", d.monitorPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Handle("quit", qmptest.Reply{Quit: true})
+
+	err = d.Kill()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []qmptest.Command{{Name: "quit"}}, server.Received())
+	assertKilled(t, cmd)
+
+	s, err := d.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Stopped, s)
+}
+
+func TestKillWithoutMonitor(t *testing.T) {
+	d, cmd := newKillableDriver(t)
+	defer os.RemoveAll(d.StorePath)
+
+	err := d.Kill()
+
+	assert.NoError(t, err)
+	assertKilled(t, cmd)
+
+	_, err = os.Stat(d.pidfilePath())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKillStoppedMachine(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	d := NewDriver("default", storePath).(*Driver)
+
+	assert.NoError(t, d.Kill())
+}
@@ -0,0 +1,366 @@
+// Package qmp is a client of the QEMU Machine Protocol, the JSON protocol of
+// the monitor of QEMU.
+//
+// See https://qemu.readthedocs.io/en/latest/interop/qmp-spec.html
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The events of the state of the machine.
+const (
+	EventShutdown  = "SHUTDOWN"
+	EventPowerdown = "POWERDOWN"
+	EventReset     = "RESET"
+	EventStop      = "STOP"
+	EventResume    = "RESUME"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind by,
+// the next ones are dropped
+const eventBuffer = 16
+
+var (
+	// ErrClosed is returned by the commands of a closed connection, or of
+	// a connection closed by QEMU, which it does when it quits.
+	ErrClosed = errors.New("QMP connection closed")
+
+	// ErrTimeout is returned by the commands QEMU did not answer in time.
+	ErrTimeout = errors.New("QMP command timed out")
+)
+
+// Error is an error QEMU returned for a command.
+type Error struct {
+	Command string `json:"-"`
+	// Class is the kind of error, such as GenericError or
+	// CommandNotFound.
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP command %s failed: %s: %s", e.Command, e.Class, e.Desc)
+}
+
+// Version is the version of QEMU.
+type Version struct {
+	QEMU struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Micro int `json:"micro"`
+	} `json:"qemu"`
+	Package string `json:"package"`
+}
+
+// Greeting is the message QEMU sends on connection.
+type Greeting struct {
+	QMP struct {
+		Version      Version  `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Timestamp is the time QEMU emitted an event at.
+type Timestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
+}
+
+// Event is an asynchronous event of QEMU.
+type Event struct {
+	Name      string                 `json:"event"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp Timestamp              `json:"timestamp"`
+}
+
+// message is any message of QEMU: a reply to a command, or an event.
+type message struct {
+	ID        json.RawMessage        `json:"id,omitempty"`
+	Return    json.RawMessage        `json:"return,omitempty"`
+	Error     *Error                 `json:"error,omitempty"`
+	Event     string                 `json:"event,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp Timestamp              `json:"timestamp"`
+}
+
+// command is a command sent to QEMU.
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        string      `json:"id"`
+}
+
+type reply struct {
+	result json.RawMessage
+	err    error
+}
+
+type subscription struct {
+	names  map[string]bool
+	events chan Event
+}
+
+// Client is a connection to the monitor of QEMU. Its commands may be run
+// concurrently, the replies are matched to them by id.
+type Client struct {
+	// Greeting is the one QEMU sent on connection.
+	Greeting Greeting
+	// Timeout bounds the wait for the reply to a command, when not zero.
+	Timeout time.Duration
+
+	conn    net.Conn
+	writeMu sync.Mutex
+	encoder *json.Encoder
+
+	mu            sync.Mutex
+	nextID        int
+	pending       map[string]chan reply
+	subscriptions map[*subscription]bool
+	err           error
+	closed        bool
+}
+
+// Dial connects to the monitor of QEMU at the given address, such as the
+// path of a unix socket, and negotiates the capabilities. The timeout
+// applies to the connection and to the commands.
+func Dial(network, address string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.Timeout = timeout
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// NewClient reads the greeting of QEMU on a connection, and switches it to
+// command mode.
+func NewClient(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:          conn,
+		encoder:       json.NewEncoder(conn),
+		pending:       map[string]chan reply{},
+		subscriptions: map[*subscription]bool{},
+	}
+
+	decoder := json.NewDecoder(conn)
+	if err := decoder.Decode(&c.Greeting); err != nil {
+		return nil, fmt.Errorf("Error reading the QMP greeting: %s", err)
+	}
+
+	go c.readLoop(decoder)
+
+	if _, err := c.Execute("qmp_capabilities", nil); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// readLoop dispatches the messages of QEMU, until the connection fails.
+func (c *Client) readLoop(decoder *json.Decoder) {
+	for {
+		var m message
+		if err := decoder.Decode(&m); err != nil {
+			c.fail(err)
+			return
+		}
+
+		if m.Event != "" {
+			c.dispatch(Event{Name: m.Event, Data: m.Data, Timestamp: m.Timestamp})
+			continue
+		}
+
+		// QEMU echoes the id of the command as it was sent
+		var id string
+		if err := json.Unmarshal(m.ID, &id); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if m.Error != nil {
+			ch <- reply{err: m.Error}
+		} else {
+			ch <- reply{result: m.Return}
+		}
+	}
+}
+
+// fail ends the pending commands and the subscriptions, with ErrClosed when
+// the connection was closed and with the error of the connection otherwise.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		if err == io.EOF || c.closed {
+			c.err = ErrClosed
+		} else {
+			c.err = fmt.Errorf("QMP connection failed: %s", err)
+		}
+	}
+
+	for id, ch := range c.pending {
+		ch <- reply{err: c.err}
+		delete(c.pending, id)
+	}
+
+	for s := range c.subscriptions {
+		close(s.events)
+		delete(c.subscriptions, s)
+	}
+}
+
+func (c *Client) dispatch(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for s := range c.subscriptions {
+		if len(s.names) > 0 && !s.names[event.Name] {
+			continue
+		}
+
+		// a subscriber falling behind must not block the replies
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+}
+
+// Execute runs a command with the given arguments, nil for none, and returns
+// its raw result.
+func (c *Client) Execute(name string, arguments interface{}) (json.RawMessage, error) {
+	ch := make(chan reply, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := c.encoder.Encode(command{Execute: name, Arguments: arguments, ID: id})
+	c.writeMu.Unlock()
+
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if c.Timeout > 0 {
+		timer := time.NewTimer(c.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-ch:
+		if qmpErr, ok := r.err.(*Error); ok {
+			qmpErr.Command = name
+		}
+		return r.result, r.err
+	case <-timeout:
+		c.forget(id)
+		return nil, ErrTimeout
+	}
+}
+
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Run runs a command and decodes its result into result, unless nil.
+func (c *Client) Run(name string, arguments, result interface{}) error {
+	raw, err := c.Execute(name, arguments)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || len(raw) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("Error reading the result of QMP command %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// Events subscribes to the events with the given names, or to all of them.
+// The channel is closed with the connection, or by calling the returned
+// function.
+func (c *Client) Events(names ...string) (<-chan Event, func()) {
+	s := &subscription{
+		names:  map[string]bool{},
+		events: make(chan Event, eventBuffer),
+	}
+	for _, name := range names {
+		s.names[name] = true
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		close(s.events)
+	} else {
+		c.subscriptions[s] = true
+	}
+	c.mu.Unlock()
+
+	unsubscribe := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.subscriptions[s] {
+			close(s.events)
+			delete(c.subscriptions, s)
+		}
+	}
+
+	return s.events, unsubscribe
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}
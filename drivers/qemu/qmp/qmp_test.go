@@ -0,0 +1,256 @@
+package qmp_test
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thelonelyghost/p2box/drivers/qemu/qmp"
+	"github.com/thelonelyghost/p2box/drivers/qemu/qmp/qmptest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(t *testing.T) (*qmptest.Server, *qmp.Client) {
+	server, err := qmptest.NewServer("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := qmp.Dial("tcp", server.Addr().String(), 5*time.Second)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+func TestDialReadsGreeting(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	assert.Equal(t, 5, client.Greeting.QMP.Version.QEMU.Major)
+	assert.Equal(t, []string{"oob"}, client.Greeting.QMP.Capabilities)
+}
+
+func TestRunDecodesResult(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	server.Handle("query-status", qmptest.Reply{Return: map[string]interface{}{"status": "running", "running": true}})
+
+	var status struct {
+		Status  string `json:"status"`
+		Running bool   `json:"running"`
+	}
+	err := client.Run("query-status", nil, &status)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "running", status.Status)
+	assert.True(t, status.Running)
+}
+
+func TestRunSendsArguments(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	server.Handle("device_del", qmptest.Reply{})
+
+	err := client.Run("device_del", map[string]interface{}{"id": "share0"}, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []qmptest.Command{
+		{Name: "device_del", Arguments: map[string]interface{}{"id": "share0"}},
+	}, server.Received())
+}
+
+func TestRunLargeReply(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	blocks := []map[string]interface{}{}
+	for i := 0; i < 500; i++ {
+		blocks = append(blocks, map[string]interface{}{"device": strings.Repeat("x", 100)})
+	}
+	server.Handle("query-block", qmptest.Reply{Return: blocks})
+
+	var result []map[string]interface{}
+	err := client.Run("query-block", nil, &result)
+
+	assert.NoError(t, err)
+	assert.Len(t, result, 500)
+}
+
+func TestRunReturnsTypedError(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	server.Handle("cont", qmptest.Reply{Error: &qmp.Error{Class: "GenericError", Desc: "Resetting the Virtual Machine is required"}})
+
+	err := client.Run("cont", nil, nil)
+	qmpErr, ok := err.(*qmp.Error)
+	assert.True(t, ok)
+	assert.Equal(t, "GenericError", qmpErr.Class)
+	assert.Equal(t, "QMP command cont failed: GenericError: Resetting the Virtual Machine is required", err.Error())
+
+	err = client.Run("no-such-command", nil, nil)
+	qmpErr, ok = err.(*qmp.Error)
+	assert.True(t, ok)
+	assert.Equal(t, "CommandNotFound", qmpErr.Class)
+}
+
+func TestEventsInterleavedWithReplies(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	events, unsubscribe := client.Events(qmp.EventShutdown)
+	defer unsubscribe()
+
+	server.Handle("system_powerdown", qmptest.Reply{
+		Events: []qmp.Event{
+			{Name: qmp.EventPowerdown},
+			{Name: qmp.EventShutdown, Data: map[string]interface{}{"guest": true}},
+		},
+	})
+
+	assert.NoError(t, client.Run("system_powerdown", nil, nil))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, qmp.EventShutdown, event.Name)
+		assert.Equal(t, true, event.Data["guest"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("No SHUTDOWN event received")
+	}
+}
+
+func TestEmittedEvents(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	events, unsubscribe := client.Events()
+	defer unsubscribe()
+
+	server.Emit(qmp.Event{Name: qmp.EventReset})
+
+	select {
+	case event := <-events:
+		assert.Equal(t, qmp.EventReset, event.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No RESET event received")
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	server.Handle("query-status", qmptest.Reply{Return: map[string]interface{}{"status": "running"}})
+	server.Handle("query-name", qmptest.Reply{Return: map[string]interface{}{"name": "box"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var status map[string]string
+			assert.NoError(t, client.Run("query-status", nil, &status))
+			assert.Equal(t, "running", status["status"])
+		}()
+		go func() {
+			defer wg.Done()
+			var name map[string]string
+			assert.NoError(t, client.Run("query-name", nil, &name))
+			assert.Equal(t, "box", name["name"])
+		}()
+	}
+	wg.Wait()
+}
+
+func TestQuitClosesConnection(t *testing.T) {
+	server, client := newServer(t)
+	defer server.Close()
+	defer client.Close()
+
+	events, _ := client.Events(qmp.EventShutdown)
+
+	server.Handle("quit", qmptest.Reply{Quit: true})
+
+	assert.NoError(t, client.Run("quit", nil, nil))
+
+	select {
+	case _, open := <-events:
+		assert.False(t, open)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The events were not closed with the connection")
+	}
+
+	assert.Equal(t, qmp.ErrClosed, client.Run("query-status", nil, nil))
+}
+
+func TestCommandTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	// a monitor which stops answering after the negotiation
+	go func() {
+		encoder := json.NewEncoder(serverConn)
+		decoder := json.NewDecoder(serverConn)
+
+		encoder.Encode(qmp.Greeting{})
+		var cmd map[string]interface{}
+		for decoder.Decode(&cmd) == nil {
+			if cmd["execute"] == "qmp_capabilities" {
+				encoder.Encode(map[string]interface{}{"return": map[string]interface{}{}, "id": cmd["id"]})
+			}
+		}
+	}()
+
+	client, err := qmp.NewClient(clientConn)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	client.Timeout = 10 * time.Millisecond
+	assert.Equal(t, qmp.ErrTimeout, client.Run("query-status", nil, nil))
+}
+
+func TestConnectionFailure(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	// a monitor which sends garbage after the negotiation
+	go func() {
+		encoder := json.NewEncoder(serverConn)
+		decoder := json.NewDecoder(serverConn)
+
+		encoder.Encode(qmp.Greeting{})
+		var cmd map[string]interface{}
+		for decoder.Decode(&cmd) == nil {
+			if cmd["execute"] == "qmp_capabilities" {
+				encoder.Encode(map[string]interface{}{"return": map[string]interface{}{}, "id": cmd["id"]})
+			} else {
+				serverConn.Write([]byte("garbage\n"))
+			}
+		}
+	}()
+
+	client, err := qmp.NewClient(clientConn)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	err = client.Run("query-status", nil, nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, qmp.ErrClosed, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "QMP connection failed: "), err.Error())
+}
@@ -0,0 +1,194 @@
+// Package qmptest provides an in-process QMP server to test the clients of
+// the monitor of QEMU against.
+package qmptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/thelonelyghost/p2box/drivers/qemu/qmp"
+)
+
+// Reply is the answer of the server to a command.
+type Reply struct {
+	// Return is the result of the command, an empty object when nil.
+	Return interface{}
+	// Error is returned instead of a result, when set.
+	Error *qmp.Error
+	// Events are sent before the reply, as QEMU may do.
+	Events []qmp.Event
+	// Quit closes the connection after the reply, as the quit command
+	// does.
+	Quit bool
+}
+
+// Command is a command the server received.
+type Command struct {
+	Name      string
+	Arguments map[string]interface{}
+}
+
+// Server is a QMP server answering the commands it was given replies for,
+// and failing the others with CommandNotFound like QEMU.
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	replies  map[string]Reply
+	received []Command
+	conns    map[net.Conn]*json.Encoder
+}
+
+// NewServer listens on the given address, such as the path of a unix socket
+// or 127.0.0.1:0.
+func NewServer(network, address string) (*Server, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: listener,
+		replies:  map[string]Reply{},
+		conns:    map[net.Conn]*json.Encoder{},
+	}
+
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Handle sets the reply to a command.
+func (s *Server) Handle(name string, reply Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replies[name] = reply
+}
+
+// Received returns the commands received so far, apart from
+// qmp_capabilities.
+func (s *Server) Received() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Command{}, s.received...)
+}
+
+// Emit sends an event to all the connected clients.
+func (s *Server) Emit(event qmp.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, encoder := range s.conns {
+		encoder.Encode(event)
+	}
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+
+	s.mu.Lock()
+	s.conns[conn] = encoder
+
+	greeting := qmp.Greeting{}
+	greeting.QMP.Version.QEMU.Major = 5
+	greeting.QMP.Capabilities = []string{"oob"}
+	encoder.Encode(greeting)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	negotiated := false
+
+	for {
+		var cmd struct {
+			Execute   string                 `json:"execute"`
+			Arguments map[string]interface{} `json:"arguments"`
+			ID        json.RawMessage        `json:"id"`
+		}
+		if err := decoder.Decode(&cmd); err != nil {
+			return
+		}
+
+		response := map[string]interface{}{}
+		if len(cmd.ID) > 0 {
+			response["id"] = cmd.ID
+		}
+
+		s.mu.Lock()
+		reply, ok := s.replies[cmd.Execute]
+
+		switch {
+		case cmd.Execute == "qmp_capabilities":
+			negotiated = true
+			response["return"] = struct{}{}
+			ok = false
+		case !negotiated:
+			response["error"] = &qmp.Error{Class: "CommandNotFound", Desc: "Expecting capabilities negotiation with 'qmp_capabilities'"}
+		default:
+			s.received = append(s.received, Command{Name: cmd.Execute, Arguments: cmd.Arguments})
+
+			if !ok {
+				response["error"] = &qmp.Error{Class: "CommandNotFound", Desc: fmt.Sprintf("The command %s has not been found", cmd.Execute)}
+			} else if reply.Error != nil {
+				response["error"] = reply.Error
+			} else if reply.Return != nil {
+				response["return"] = reply.Return
+			} else {
+				response["return"] = struct{}{}
+			}
+		}
+
+		if ok {
+			for _, event := range reply.Events {
+				encoder.Encode(event)
+			}
+		}
+		encoder.Encode(response)
+		s.mu.Unlock()
+
+		if ok && reply.Quit {
+			return
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+const (
+	fsType9p       = "9p"
+	fsTypeVirtiofs = "virtiofs"
+)
+
+// share is a host directory mounted in the guest.
+type share struct {
+	hostPath  string
+	guestPath string
+	tag       string
+	fsType    string
+	// virtiofsd serves a virtiofs share
+	virtiofsd *os.Process
+}
+
+// parseShareFolder parses a HOST[:GUEST] share folder, the directory being
+// mounted at the same path in the guest when GUEST is omitted.
+func parseShareFolder(value string) (string, string, error) {
+	hostPath, guestPath := value, ""
+	if i := strings.LastIndex(value, ":"); i > 0 && strings.HasPrefix(value[i+1:], "/") {
+		hostPath, guestPath = value[:i], value[i+1:]
+	}
+
+	if !filepath.IsAbs(hostPath) {
+		return "", "", fmt.Errorf("Invalid share folder %q, the host directory must be an absolute path", value)
+	}
+	if guestPath == "" {
+		guestPath = filepath.ToSlash(hostPath)
+	}
+	if !path.IsAbs(guestPath) {
+		return "", "", fmt.Errorf("Invalid share folder %q, the guest directory must be an absolute path", value)
+	}
+
+	return filepath.Clean(hostPath), path.Clean(guestPath), nil
+}
+
+// setShareFolders checks the share folders, and shares the home directory
+// when there are none.
+func (d *Driver) setShareFolders(shareFolders []string) error {
+	if d.NoShare {
+		if len(shareFolders) > 0 {
+			return fmt.Errorf("--qemu-share-folder cannot be used with --qemu-no-share")
+		}
+		return nil
+	}
+
+	if len(shareFolders) == 0 {
+		shareFolders = []string{mcnutils.GetHomeDir()}
+	}
+
+	for _, shareFolder := range shareFolders {
+		hostPath, _, err := parseShareFolder(shareFolder)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(hostPath); err != nil {
+			return fmt.Errorf("Error sharing %s: %s", hostPath, err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("Error sharing %s: not a directory", hostPath)
+		}
+	}
+
+	d.ShareFolders = shareFolders
+	return nil
+}
+
+// startShares prepares the shares of the machine, with virtiofs when a
+// virtiofsd can be started for them and with virtio-9p otherwise. The
+// virtiofsd processes are left for stopShares when QEMU fails to start.
+func (d *Driver) startShares() ([]share, error) {
+	if d.NoShare {
+		return nil, nil
+	}
+
+	shares := []share{}
+	for i, shareFolder := range d.ShareFolders {
+		hostPath, guestPath, err := parseShareFolder(shareFolder)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(hostPath); err != nil {
+			log.Warnf("Not sharing %s: %s", hostPath, err)
+			continue
+		}
+
+		shares = append(shares, share{
+			hostPath:  hostPath,
+			guestPath: guestPath,
+			tag:       fmt.Sprintf("share%d", i),
+			fsType:    fsType9p,
+		})
+	}
+
+	virtiofsd, ok := lookVirtiofsd()
+	if !ok || len(shares) == 0 {
+		return shares, nil
+	}
+
+	for i := range shares {
+		process, err := startVirtiofsd(virtiofsd, d.virtiofsSocketPath(shares[i].tag), shares[i].hostPath)
+		if err != nil {
+			log.Warnf("Error starting virtiofsd, sharing %s with 9p: %s", shares[i].hostPath, err)
+			continue
+		}
+		shares[i].fsType = fsTypeVirtiofs
+		shares[i].virtiofsd = process
+	}
+
+	return shares, nil
+}
+
+// stopShares stops the virtiofsd processes, which are otherwise left running
+// without a QEMU to disconnect from them.
+func stopShares(shares []share) {
+	for _, s := range shares {
+		if s.virtiofsd == nil {
+			continue
+		}
+		if err := s.virtiofsd.Kill(); err != nil {
+			log.Debugf("Error stopping virtiofsd: %s", err)
+		}
+	}
+}
+
+// shareArgs returns the QEMU arguments of the shares. The virtiofs shares are
+// also shared with virtio-9p, for the guests without virtiofs.
+func (d *Driver) shareArgs(shares []share) []string {
+	args := []string{}
+	memoryShared := false
+
+	for _, s := range shares {
+		switch s.fsType {
+		case fsTypeVirtiofs:
+			// vhost-user devices need the guest memory to be shared
+			// with virtiofsd
+			if !memoryShared {
+				args = append(args,
+					"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", d.Memory),
+					"-numa", "node,memdev=mem")
+				memoryShared = true
+			}
+			args = append(args,
+				"-chardev", fmt.Sprintf("socket,id=%s,path=%s", s.tag, escapeOptionValue(d.virtiofsSocketPath(s.tag))),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=%s,tag=%s", s.tag, s.tag))
+			args = append(args, virtio9pArgs(s.fallbackTag(), s.hostPath)...)
+		default:
+			args = append(args, virtio9pArgs(s.tag, s.hostPath)...)
+		}
+	}
+
+	return args
+}
+
+func virtio9pArgs(tag, hostPath string) []string {
+	return []string{
+		"-fsdev", fmt.Sprintf("local,id=%s,path=%s,security_model=none", tag, escapeOptionValue(hostPath)),
+		"-device", fmt.Sprintf("virtio-9p-pci,fsdev=%s,mount_tag=%s", tag, tag),
+	}
+}
+
+// fallbackTag is the tag of the virtio-9p device of a virtiofs share.
+func (s share) fallbackTag() string {
+	return s.tag + "-9p"
+}
+
+// mountCommand returns the command mounting a share in the guest. A virtiofs
+// share is mounted with virtio-9p when the guest kernel lacks virtiofs.
+func (s share) mountCommand() string {
+	guestPath := shellQuote(s.guestPath)
+	mount9p := func(tag string) string {
+		return fmt.Sprintf("sudo mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 %s %s", tag, guestPath)
+	}
+
+	if s.fsType == fsTypeVirtiofs {
+		return fmt.Sprintf("sudo mkdir -p %s && { sudo mount -t virtiofs %s %s || %s; }",
+			guestPath, s.tag, guestPath, mount9p(s.fallbackTag()))
+	}
+
+	return fmt.Sprintf("sudo mkdir -p %s && %s", guestPath, mount9p(s.tag))
+}
+
+// mountShares mounts the shares in the guest, over SSH. A share which fails
+// to mount only gets a warning, the machine is usable without it.
+func (d *Driver) mountShares(shares []share) error {
+	if len(shares) == 0 {
+		return nil
+	}
+
+	if err := drivers.WaitForSSH(d); err != nil {
+		return err
+	}
+
+	for _, s := range shares {
+		log.Infof("Mounting %s at %s in the machine (%s)...", s.hostPath, s.guestPath, s.fsType)
+		if _, err := drivers.RunSSHCommandFromDriver(d, s.mountCommand()); err != nil {
+			log.Warnf("Error mounting %s in the machine: %s", s.hostPath, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) virtiofsSocketPath(tag string) string {
+	machineDir := filepath.Join(d.StorePath, "machines", d.GetMachineName())
+	return filepath.Join(machineDir, "virtiofs-"+tag+".sock")
+}
+
+// escapeOptionValue escapes the value of a QEMU option, in which commas
+// separate the options unless doubled.
+func escapeOptionValue(value string) string {
+	return strings.Replace(value, ",", ",,", -1)
+}
+
+// shellQuote quotes a word for the shell of the guest.
+func shellQuote(word string) string {
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
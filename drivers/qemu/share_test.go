@@ -0,0 +1,138 @@
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShareFolder(t *testing.T) {
+	testCases := []struct {
+		value     string
+		hostPath  string
+		guestPath string
+		err       bool
+	}{
+		{"/home/user", "/home/user", "/home/user", false},
+		{"/home/user/src:/src", "/home/user/src", "/src", false},
+		{"/home/user/a:b", "/home/user/a:b", "/home/user/a:b", false},
+		{"/home/user/:/src/", "/home/user", "/src", false},
+		{"src:/src", "", "", true},
+		{"", "", "", true},
+	}
+
+	for _, tc := range testCases {
+		hostPath, guestPath, err := parseShareFolder(tc.value)
+
+		if tc.err {
+			assert.Error(t, err, tc.value)
+			continue
+		}
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.hostPath, hostPath, tc.value)
+		assert.Equal(t, tc.guestPath, guestPath, tc.value)
+	}
+}
+
+func setConfig(t *testing.T, values map[string]interface{}) (*Driver, error) {
+	driver := NewDriver("default", "path").(*Driver)
+
+	checkFlags := &drivers.CheckDriverOptions{
+		FlagsValues: values,
+		CreateFlags: driver.GetCreateFlags(),
+	}
+
+	err := driver.SetConfigFromFlags(checkFlags)
+	assert.Empty(t, checkFlags.InvalidFlags)
+
+	return driver, err
+}
+
+func TestShareFoldersDefaultToHome(t *testing.T) {
+	driver, err := setConfig(t, map[string]interface{}{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{mcnutils.GetHomeDir()}, driver.ShareFolders)
+}
+
+func TestShareFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver, err := setConfig(t, map[string]interface{}{
+		"qemu-share-folder": []string{dir + ":/src"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{dir + ":/src"}, driver.ShareFolders)
+
+	_, err = setConfig(t, map[string]interface{}{
+		"qemu-share-folder": []string{dir + "/missing"},
+	})
+
+	assert.Error(t, err)
+}
+
+func TestNoShare(t *testing.T) {
+	driver, err := setConfig(t, map[string]interface{}{
+		"qemu-no-share": true,
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, driver.ShareFolders)
+
+	_, err = setConfig(t, map[string]interface{}{
+		"qemu-no-share":     true,
+		"qemu-share-folder": []string{"/src"},
+	})
+
+	assert.Error(t, err)
+}
+
+func TestShareArgs(t *testing.T) {
+	driver := NewDriver("default", "/store").(*Driver)
+	driver.Memory = 2048
+
+	args := driver.shareArgs([]share{
+		{hostPath: "/home/user", guestPath: "/home/user", tag: "share0", fsType: fsType9p},
+		{hostPath: "/src", guestPath: "/src", tag: "share1", fsType: fsTypeVirtiofs},
+	})
+
+	assert.Equal(t, []string{
+		"-fsdev", "local,id=share0,path=/home/user,security_model=none",
+		"-device", "virtio-9p-pci,fsdev=share0,mount_tag=share0",
+		"-object", "memory-backend-memfd,id=mem,size=2048M,share=on",
+		"-numa", "node,memdev=mem",
+		"-chardev", "socket,id=share1,path=/store/machines/default/virtiofs-share1.sock",
+		"-device", "vhost-user-fs-pci,chardev=share1,tag=share1",
+		"-fsdev", "local,id=share1-9p,path=/src,security_model=none",
+		"-device", "virtio-9p-pci,fsdev=share1-9p,mount_tag=share1-9p",
+	}, args)
+}
+
+func TestShareArgsEscapeCommas(t *testing.T) {
+	driver := NewDriver("a,b", "/store").(*Driver)
+
+	args := driver.shareArgs([]share{
+		{hostPath: "/home/u/a,b", guestPath: "/src", tag: "share0", fsType: fsType9p},
+		{hostPath: "/src", guestPath: "/src", tag: "share1", fsType: fsTypeVirtiofs},
+	})
+
+	assert.Equal(t, "local,id=share0,path=/home/u/a,,b,security_model=none", args[1])
+	assert.Equal(t, "socket,id=share1,path=/store/machines/a,,b/virtiofs-share1.sock", args[9])
+}
+
+func TestMountCommand(t *testing.T) {
+	s9p := share{guestPath: "/home/o'neil", tag: "share0", fsType: fsType9p}
+	virtiofs := share{guestPath: "/src", tag: "share1", fsType: fsTypeVirtiofs}
+
+	assert.Equal(t, `sudo mkdir -p '/home/o'\''neil' && sudo mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 share0 '/home/o'\''neil'`, s9p.mountCommand())
+	assert.Equal(t, `sudo mkdir -p '/src' && { sudo mount -t virtiofs share1 '/src' || sudo mount -t 9p -o trans=virtio,version=9p2000.L,msize=512000 share1-9p '/src'; }`, virtiofs.mountCommand())
+}
@@ -0,0 +1,111 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+// virtiofsdPaths are where the distributions install virtiofsd, outside of
+// the PATH: the Rust one or the C one which came with QEMU before 8.0.
+var virtiofsdPaths = []string{
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+	"/usr/lib/virtiofsd",
+}
+
+func lookVirtiofsd() (string, bool) {
+	if virtiofsd, err := exec.LookPath("virtiofsd"); err == nil {
+		return virtiofsd, true
+	}
+
+	for _, virtiofsd := range virtiofsdPaths {
+		if _, err := os.Stat(virtiofsd); err == nil {
+			return virtiofsd, true
+		}
+	}
+
+	return "", false
+}
+
+// startVirtiofsd starts a virtiofsd serving dir on the socket, in its own
+// session so that it outlives the command. It exits when QEMU disconnects.
+func startVirtiofsd(virtiofsd, socketPath, dir string) (*os.Process, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	args, err := virtiofsdArgs(virtiofsd, socketPath, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("executing: %v %v", virtiofsd, args)
+	cmd := exec.Command(virtiofsd, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	if err := mcnutils.WaitForSpecific(func() bool {
+		select {
+		case <-exited:
+			return true
+		default:
+		}
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 50, 100*time.Millisecond); err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("virtiofsd did not create %s", socketPath)
+	}
+
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, fmt.Errorf("virtiofsd exited without serving %s", dir)
+	}
+
+	return cmd.Process, nil
+}
+
+// virtiofsdArgs returns the arguments of the Rust virtiofsd, or of the C one
+// which only has -o options, told apart by their help.
+func virtiofsdArgs(virtiofsd, socketPath, dir string) ([]string, error) {
+	// the C virtiofsd exits with an error after its help
+	help, _ := exec.Command(virtiofsd, "--help").CombinedOutput()
+
+	return virtiofsdArgsFor(strings.Contains(string(help), "--shared-dir"), socketPath, dir, os.Geteuid() == 0)
+}
+
+func virtiofsdArgsFor(rust bool, socketPath, dir string, root bool) ([]string, error) {
+	if rust {
+		args := []string{"--socket-path", socketPath, "--shared-dir", dir}
+		if !root {
+			// the namespace sandbox needs root
+			args = append(args, "--sandbox", "none")
+		}
+		return args, nil
+	}
+
+	// the -o options are separated by commas, which cannot be escaped
+	if strings.Contains(dir, ",") {
+		return nil, fmt.Errorf("the C virtiofsd cannot share %s, whose path has a comma", dir)
+	}
+
+	// and it has no sandbox an unprivileged user can set up
+	if !root {
+		return nil, fmt.Errorf("the C virtiofsd only runs as root")
+	}
+
+	return []string{"--socket-path=" + socketPath, "-o", "source=" + dir}, nil
+}
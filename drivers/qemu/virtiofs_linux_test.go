@@ -0,0 +1,39 @@
+package qemu
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtiofsdArgs(t *testing.T) {
+	args, err := virtiofsdArgsFor(true, "/m/share0.sock", "/home/u", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--socket-path", "/m/share0.sock", "--shared-dir", "/home/u", "--sandbox", "none"}, args)
+
+	args, err = virtiofsdArgsFor(true, "/m/share0.sock", "/home/u", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--socket-path", "/m/share0.sock", "--shared-dir", "/home/u"}, args)
+
+	_, err = virtiofsdArgsFor(false, "/m/share0.sock", "/home/u", false)
+	assert.Error(t, err)
+
+	args, err = virtiofsdArgsFor(false, "/m/share0.sock", "/home/u", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--socket-path=/m/share0.sock", "-o", "source=/home/u"}, args)
+
+	_, err = virtiofsdArgsFor(false, "/m/share0.sock", "/home/u/a,b", true)
+	assert.Error(t, err)
+}
+
+func TestStopShares(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep is not available")
+	}
+
+	stopShares([]share{{tag: "share0", fsType: fsType9p}, {tag: "share1", fsType: fsTypeVirtiofs, virtiofsd: cmd.Process}})
+
+	assert.Error(t, cmd.Wait())
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package qemu
+
+import (
+	"errors"
+	"os"
+)
+
+// virtiofsd only runs on Linux hosts
+func lookVirtiofsd() (string, bool) {
+	return "", false
+}
+
+func startVirtiofsd(virtiofsd, socketPath, dir string) (*os.Process, error) {
+	return nil, errors.New("virtiofs is only supported on Linux hosts")
+}
@@ -15,6 +15,7 @@ import (
 type B2PUpdater interface {
 	UpdateISOCache(storePath, isoURL string) error
 	CopyIsoToMachineDir(storePath, machineName, isoURL string) error
+	VerifyMachineIso(storePath, machineName, checksum string) error
 }
 
 func NewB2PUpdater() B2PUpdater {
@@ -27,6 +28,10 @@ func (u *b2pUtilsUpdater) CopyIsoToMachineDir(storePath, machineName, isoURL str
 	return mcnutils.NewB2pUtils(storePath).CopyIsoToMachineDir(isoURL, machineName)
 }
 
+func (u *b2pUtilsUpdater) VerifyMachineIso(storePath, machineName, checksum string) error {
+	return mcnutils.NewB2pUtils(storePath).VerifyMachineIso(machineName, checksum)
+}
+
 func (u *b2pUtilsUpdater) UpdateISOCache(storePath, isoURL string) error {
 	return mcnutils.NewB2pUtils(storePath).UpdateISOCache(isoURL)
 }
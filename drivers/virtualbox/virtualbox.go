@@ -16,6 +16,7 @@ import (
 	"github.com/thelonelyghost/p2box/libmachine/drivers"
 	"github.com/thelonelyghost/p2box/libmachine/log"
 	"github.com/thelonelyghost/p2box/libmachine/mcnflag"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
 	"github.com/thelonelyghost/p2box/libmachine/state"
 )
 
@@ -57,6 +58,7 @@ type Driver struct {
 	DiskSize            int
 	NatNicType          string
 	Boot2PodmanURL      string
+	Boot2PodmanChecksum string
 	HostDNSResolver     bool
 	HostOnlyCIDR        string
 	HostOnlyNicType     string
@@ -126,6 +128,11 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Value:  defaultBoot2PodmanURL,
 			EnvVar: "VIRTUALBOX_BOOT2PODMAN_URL",
 		},
+		mcnflag.StringFlag{
+			Name:   "virtualbox-boot2podman-checksum",
+			Usage:  "The sha256:DIGEST checksum the boot2podman image must have",
+			EnvVar: "VIRTUALBOX_BOOT2PODMAN_CHECKSUM",
+		},
 		mcnflag.BoolFlag{
 			Name:   "virtualbox-host-dns-resolver",
 			Usage:  "Use the host DNS resolver",
@@ -222,6 +229,7 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.Memory = flags.Int("virtualbox-memory")
 	d.DiskSize = flags.Int("virtualbox-disk-size")
 	d.Boot2PodmanURL = flags.String("virtualbox-boot2podman-url")
+	d.Boot2PodmanChecksum = flags.String("virtualbox-boot2podman-checksum")
 	d.SSHUser = "tc"
 	d.HostDNSResolver = flags.Bool("virtualbox-host-dns-resolver")
 	d.NatNicType = flags.String("virtualbox-nat-nictype")
@@ -235,6 +243,16 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.NoVTXCheck = flags.Bool("virtualbox-no-vtx-check")
 	d.ShareFolder = flags.String("virtualbox-share-folder")
 
+	if d.Boot2PodmanChecksum != "" {
+		if _, err := mcnutils.ParseChecksum(d.Boot2PodmanChecksum); err != nil {
+			return err
+		}
+	}
+
+	// the driver downloads the ISO or image in its own process
+	if err := mcnutils.ConfigureProxy(flags.String("engine-proxy")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -289,6 +307,12 @@ func (d *Driver) CreateVM() error {
 		return err
 	}
 
+	if d.Boot2PodmanChecksum != "" {
+		if err := d.b2pUpdater.VerifyMachineIso(d.StorePath, d.MachineName, d.Boot2PodmanChecksum); err != nil {
+			return err
+		}
+	}
+
 	log.Info("Creating VirtualBox VM...")
 
 	log.Infof("Creating SSH key...")
@@ -540,7 +564,7 @@ func (d *Driver) Start() error {
 
 	// This happens a lot on windows. The adapter has an invalid IP and the VM has the same IP
 	log.Warn("The host-only adapter is corrupted. Let's stop the VM, fix the host-only adapter and restart the VM")
-	if err := d.Stop(); err != nil {
+	if err := d.stopAndWait(); err != nil {
 		return err
 	}
 
@@ -579,6 +603,17 @@ func (d *Driver) Stop() error {
 	if err := d.vbm("controlvm", d.MachineName, "acpipowerbutton"); err != nil {
 		return err
 	}
+
+	d.IPAddress = ""
+
+	return nil
+}
+
+// stopAndWait stops the VM and waits for the guest to shut down.
+func (d *Driver) stopAndWait() error {
+	if err := d.Stop(); err != nil {
+		return err
+	}
 	for {
 		s, err := d.GetState()
 		if err != nil {
@@ -591,14 +626,12 @@ func (d *Driver) Stop() error {
 		}
 	}
 
-	d.IPAddress = ""
-
 	return nil
 }
 
 // Restart restarts a machine which is known to be running.
 func (d *Driver) Restart() error {
-	if err := d.Stop(); err != nil {
+	if err := d.stopAndWait(); err != nil {
 		return fmt.Errorf("Problem stopping the VM: %s", err)
 	}
 
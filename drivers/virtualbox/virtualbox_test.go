@@ -459,6 +459,11 @@ func (v *MockCreateOperations) CopyIsoToMachineDir(storePath, machineName, isoUR
 	return err
 }
 
+func (v *MockCreateOperations) VerifyMachineIso(storePath, machineName, checksum string) error {
+	_, err := v.doCall("VerifyMachineIso " + storePath + " " + machineName + " " + checksum)
+	return err
+}
+
 func (v *MockCreateOperations) Generate(path string) error {
 	_, err := v.doCall("Generate " + path)
 	return err
@@ -600,6 +605,21 @@ func TestCreateVMWithSpecificNatNicType(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCreateVMWithChecksumMismatch(t *testing.T) {
+	checksum := "sha256:" + strings.Repeat("0", 64)
+
+	driver := NewDriver("default", "path")
+	driver.Boot2PodmanChecksum = checksum
+	mockCalls(t, driver, []Call{
+		{"CopyIsoToMachineDir path default http://b2p.org", "", nil},
+		{"VerifyMachineIso path default " + checksum, "", errors.New("Checksum mismatch")},
+	})
+
+	err := driver.CreateVM()
+
+	assert.EqualError(t, err, "Checksum mismatch")
+}
+
 func TestStart(t *testing.T) {
 	driver := NewDriver("default", "path")
 	mockCalls(t, driver, []Call{
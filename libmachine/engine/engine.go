@@ -10,8 +10,15 @@ type Options struct {
 	Labels           []string
 	LogLevel         string
 	StorageDriver    string
+	StorageOpts      []string
 	SelinuxEnabled   bool
 	TLSVerify        bool `json:"TlsVerify"`
 	RegistryMirror   []string
 	InstallURL       string
+	Rootless         bool
+	HTTPProxy        string
+	HTTPSProxy       string
+	NoProxy          string
+	TrustCAs         []string
+	InheritHostCAs   bool
 }
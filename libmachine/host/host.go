@@ -1,8 +1,11 @@
 package host
 
 import (
+	"fmt"
+	"io"
 	"os/exec"
 	"regexp"
+	"time"
 
 	"github.com/thelonelyghost/p2box/libmachine/auth"
 	"github.com/thelonelyghost/p2box/libmachine/cert"
@@ -17,9 +20,17 @@ import (
 	"github.com/thelonelyghost/p2box/libmachine/state"
 )
 
+// DefaultStopTimeout is how long Stop waits for a machine to shut down
+// cleanly before it kills it.
+const DefaultStopTimeout = 60 * time.Second
+
 var (
 	validHostNamePattern                  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-\.]*$`)
 	stdSSHClientCreator  SSHClientCreator = &StandardSSHClientCreator{}
+
+	// stopPollInterval is how often StopWithTimeout checks whether the
+	// machine has stopped
+	stopPollInterval = time.Second
 )
 
 type SSHClientCreator interface {
@@ -51,6 +62,27 @@ type Options struct {
 	Disk          int
 	EngineOptions *engine.Options
 	AuthOptions   *auth.Options
+	// Provisioner, when set, is used instead of detecting one
+	Provisioner string
+	// CopyFiles are copied to the machine after provisioning, given as
+	// LOCAL:REMOTE[:mode]
+	CopyFiles []string
+	// ProvisionScripts are local scripts run on the machine after the
+	// files are copied
+	ProvisionScripts []string
+	// SyncRegistryAuth copies the registry credentials of this host to the
+	// machine whenever it is provisioned or started
+	SyncRegistryAuth bool
+	// RegistryAuthFile is copied instead of the auth file of Podman
+	RegistryAuthFile string
+	// SyncRegistries limits the copied credentials to these registries
+	SyncRegistries []string
+	// EngineVersion is the version of podman installed by the last upgrade
+	// or rollback, the release of the ISO on boot2podman
+	EngineVersion string
+	// PreviousEngineVersion is the version of podman before the last
+	// upgrade, which a rollback returns to
+	PreviousEngineVersion string
 }
 
 type Metadata struct {
@@ -161,8 +193,18 @@ func (h *Host) runActionForState(action func() error, desiredState state.State)
 	return mcnutils.WaitFor(drivers.MachineInState(h.Driver, desiredState))
 }
 
+// DetectProvisioner returns the provisioner chosen at creation, if any, or
+// detects one from the operating system of the machine.
+func (h *Host) DetectProvisioner() (provision.Provisioner, error) {
+	if h.HostOptions != nil && h.HostOptions.Provisioner != "" {
+		return provision.ProvisionerByName(h.HostOptions.Provisioner, h.Driver)
+	}
+
+	return provision.DetectProvisioner(h.Driver)
+}
+
 func (h *Host) WaitForPodman() error {
-	provisioner, err := provision.DetectProvisioner(h.Driver)
+	provisioner, err := h.DetectProvisioner()
 	if err != nil {
 		return err
 	}
@@ -178,19 +220,64 @@ func (h *Host) Start() error {
 
 	log.Infof("Machine %q was started.", h.Name)
 
-	return h.WaitForPodman()
+	if err := h.WaitForPodman(); err != nil {
+		return err
+	}
+
+	h.resyncRegistryAuth()
+
+	return nil
 }
 
 func (h *Host) Stop() error {
+	return h.StopWithTimeout(DefaultStopTimeout)
+}
+
+// StopWithTimeout shuts a machine down cleanly, and kills it when it is still
+// running after the timeout. A zero timeout kills it right away.
+func (h *Host) StopWithTimeout(timeout time.Duration) error {
+	if drivers.MachineInState(h.Driver, state.Stopped)() {
+		return mcnerror.ErrHostAlreadyInState{
+			Name:  h.Name,
+			State: state.Stopped,
+		}
+	}
+
+	if timeout <= 0 {
+		return h.killUnlessStopped()
+	}
+
 	log.Infof("Stopping %q...", h.Name)
-	if err := h.runActionForState(h.Driver.Stop, state.Stopped); err != nil {
-		return err
+	if err := h.Driver.Stop(); err != nil {
+		log.Warnf("Error stopping %q cleanly, killing it: %s", h.Name, err)
+		return h.killUnlessStopped()
+	}
+
+	interval := stopPollInterval
+	if timeout < interval {
+		interval = timeout
+	}
+
+	if err := mcnutils.WaitForSpecific(drivers.MachineInState(h.Driver, state.Stopped), int(timeout/interval), interval); err != nil {
+		log.Warnf("Machine %q did not stop within %s, killing it...", h.Name, timeout)
+		return h.killUnlessStopped()
 	}
 
 	log.Infof("Machine %q was stopped.", h.Name)
 	return nil
 }
 
+// killUnlessStopped kills a machine, which may have stopped in the meantime.
+func (h *Host) killUnlessStopped() error {
+	if err := h.Kill(); err != nil {
+		if _, ok := err.(mcnerror.ErrHostAlreadyInState); !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (h *Host) Kill() error {
 	log.Infof("Killing %q...", h.Name)
 	if err := h.runActionForState(h.Driver.Kill, state.Stopped); err != nil {
@@ -204,9 +291,8 @@ func (h *Host) Kill() error {
 func (h *Host) Restart() error {
 	log.Infof("Restarting %q...", h.Name)
 	if drivers.MachineInState(h.Driver, state.Stopped)() {
-		if err := h.Start(); err != nil {
-			return err
-		}
+		// Start waits for Podman and copies the credentials itself
+		return h.Start()
 	} else if drivers.MachineInState(h.Driver, state.Running)() {
 		if err := h.Driver.Restart(); err != nil {
 			return err
@@ -216,33 +302,135 @@ func (h *Host) Restart() error {
 		}
 	}
 
-	return h.WaitForPodman()
+	if err := h.WaitForPodman(); err != nil {
+		return err
+	}
+
+	h.resyncRegistryAuth()
+
+	return nil
 }
 
 func (h *Host) Upgrade() error {
+	return h.UpgradeTo("")
+}
+
+// startForUpgrade starts the machine, if needed, and returns its provisioner.
+// The ISO of the upgrade is downloaded through the proxy the machine was
+// created with.
+func (h *Host) startForUpgrade() (provision.Provisioner, error) {
+	if h.HostOptions != nil && h.HostOptions.EngineOptions != nil {
+		if err := mcnutils.ConfigureHostProxy(h.HostOptions.EngineOptions.HTTPProxy, h.HostOptions.EngineOptions.HTTPSProxy); err != nil {
+			return nil, err
+		}
+	}
+
 	machineState, err := h.Driver.GetState()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if machineState != state.Running {
 		log.Info("Starting machine so machine can be upgraded...")
 		if err := h.Start(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	provisioner, err := provision.DetectProvisioner(h.Driver)
+	return h.DetectProvisioner()
+}
+
+// UpgradeTo upgrades podman to the given version, a release tag of the ISO
+// on boot2podman or a package version elsewhere, or to the latest version
+// when empty. The version it replaces is recorded for Rollback.
+func (h *Host) UpgradeTo(version string) error {
+	provisioner, err := h.startForUpgrade()
+	if err != nil {
+		return err
+	}
+
+	packager, versioned := provisioner.(provision.VersionedPackager)
+	if version != "" && !versioned {
+		return fmt.Errorf("The %s provisioner cannot install a given version of podman", provisioner.String())
+	}
+
+	previous := ""
+	if versioned {
+		if previous, err = packager.PackageVersion("podman"); err != nil {
+			log.Warnf("Unable to get the installed version of podman: %s", err)
+		}
+	}
+
+	if version == "" {
+		log.Info("Upgrading podman...")
+		err = provisioner.Package("podman", pkgaction.Upgrade)
+	} else {
+		log.Infof("Installing podman %s...", version)
+		err = packager.InstallPackageVersion("podman", version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !versioned {
+		return nil
+	}
+
+	current, err := packager.PackageVersion("podman")
+	if err != nil {
+		log.Warnf("Unable to get the installed version of podman: %s", err)
+		return nil
+	}
+
+	if previous != "" && previous != current {
+		h.HostOptions.PreviousEngineVersion = previous
+	}
+	h.HostOptions.EngineVersion = current
+
+	return nil
+}
+
+// Rollback returns podman to the version it had before the last upgrade.
+func (h *Host) Rollback() error {
+	provisioner, err := h.startForUpgrade()
 	if err != nil {
 		return err
 	}
 
-	log.Info("Upgrading podman...")
-	if err := provisioner.Package("podman", pkgaction.Upgrade); err != nil {
+	if rollbacker, ok := provisioner.(provision.PackageRollbacker); ok {
+		log.Info("Rolling back podman...")
+		err = rollbacker.RollbackPackage("podman")
+	} else {
+		previous := h.HostOptions.PreviousEngineVersion
+		if previous == "" {
+			return fmt.Errorf("No previous version of podman recorded for %q, it was not upgraded", h.Name)
+		}
+
+		packager, ok := provisioner.(provision.VersionedPackager)
+		if !ok {
+			return fmt.Errorf("The %s provisioner cannot install a given version of podman", provisioner.String())
+		}
+
+		log.Infof("Rolling back podman to %s...", previous)
+		err = packager.InstallPackageVersion("podman", previous)
+	}
+	if err != nil {
 		return err
 	}
 
-	return err
+	// the version rolled back from becomes the one to roll back to
+	h.HostOptions.PreviousEngineVersion = h.HostOptions.EngineVersion
+
+	if packager, ok := provisioner.(provision.VersionedPackager); ok {
+		current, err := packager.PackageVersion("podman")
+		if err != nil {
+			log.Warnf("Unable to get the installed version of podman: %s", err)
+			current = ""
+		}
+		h.HostOptions.EngineVersion = current
+	}
+
+	return nil
 }
 
 func (h *Host) URL() (string, error) {
@@ -257,7 +445,7 @@ func (h *Host) AuthOptions() *auth.Options {
 }
 
 func (h *Host) ConfigureAuth() error {
-	provisioner, err := provision.DetectProvisioner(h.Driver)
+	provisioner, err := h.DetectProvisioner()
 	if err != nil {
 		return err
 	}
@@ -267,7 +455,11 @@ func (h *Host) ConfigureAuth() error {
 	// and modularity of the provisioners should be).
 	//
 	// Call provision to re-provision the certs properly.
-	return provisioner.Provision(*h.HostOptions.AuthOptions, *h.HostOptions.EngineOptions)
+	if err := provisioner.Provision(*h.HostOptions.AuthOptions, *h.HostOptions.EngineOptions); err != nil {
+		return err
+	}
+
+	return h.RunUserProvisioning(provisioner)
 }
 
 func (h *Host) ConfigureAllAuth() error {
@@ -279,10 +471,73 @@ func (h *Host) ConfigureAllAuth() error {
 }
 
 func (h *Host) Provision() error {
-	provisioner, err := provision.DetectProvisioner(h.Driver)
+	provisioner, err := h.DetectProvisioner()
 	if err != nil {
 		return err
 	}
 
-	return provisioner.Provision(*h.HostOptions.AuthOptions, *h.HostOptions.EngineOptions)
+	if err := provisioner.Provision(*h.HostOptions.AuthOptions, *h.HostOptions.EngineOptions); err != nil {
+		return err
+	}
+
+	return h.RunUserProvisioning(provisioner)
+}
+
+// RunUserProvisioning copies the files and runs the scripts given at
+// creation, after the provisioner is done.
+func (h *Host) RunUserProvisioning(provisioner provision.Provisioner) error {
+	if h.HostOptions == nil {
+		return nil
+	}
+
+	if h.HostOptions.SyncRegistryAuth {
+		if err := provision.SyncRegistryAuth(provisioner, *h.HostOptions.EngineOptions, h.HostOptions.RegistryAuthFile, h.HostOptions.SyncRegistries); err != nil {
+			return err
+		}
+	}
+
+	if err := provision.CopyFiles(provisioner, h.HostOptions.CopyFiles); err != nil {
+		return err
+	}
+
+	return provision.RunScripts(provisioner, h.HostOptions.ProvisionScripts)
+}
+
+// SyncRegistryAuth copies registry credentials from a local auth file, the
+// one of Podman when empty, to the machine. Without registries, all of them
+// are copied.
+func (h *Host) SyncRegistryAuth(authFile string, registries []string) error {
+	provisioner, err := h.DetectProvisioner()
+	if err != nil {
+		return err
+	}
+
+	return provision.SyncRegistryAuth(provisioner, *h.HostOptions.EngineOptions, authFile, registries)
+}
+
+// resyncRegistryAuth copies the registry credentials again after a boot,
+// since Podman keeps them in a runtime directory. The machine works without
+// them, so failures are only reported.
+func (h *Host) resyncRegistryAuth() {
+	if h.HostOptions == nil || !h.HostOptions.SyncRegistryAuth {
+		return
+	}
+
+	if err := h.SyncRegistryAuth(h.HostOptions.RegistryAuthFile, h.HostOptions.SyncRegistries); err != nil {
+		log.Warnf("Error copying registry credentials to %q: %s", h.Name, err)
+	}
+}
+
+// ProvisionDryRun writes what Provision would change on the machine to w.
+func (h *Host) ProvisionDryRun(w io.Writer) error {
+	provisioner, err := h.DetectProvisioner()
+	if err != nil {
+		return err
+	}
+
+	if err := provision.DryRun(provisioner, *h.HostOptions.AuthOptions, *h.HostOptions.EngineOptions, w); err != nil {
+		return err
+	}
+
+	return provision.DryRunUserProvisioning(provisioner, h.HostOptions.SyncRegistryAuth, h.HostOptions.RegistryAuthFile, h.HostOptions.CopyFiles, h.HostOptions.ProvisionScripts, w)
 }
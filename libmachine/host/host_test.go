@@ -2,6 +2,7 @@ package host
 
 import (
 	"testing"
+	"time"
 
 	"github.com/thelonelyghost/p2box/drivers/fakedriver"
 	_ "github.com/thelonelyghost/p2box/drivers/none"
@@ -55,3 +56,116 @@ func TestStart(t *testing.T) {
 		t.Fatalf("Expected no error but got one: %s", err)
 	}
 }
+
+// hungDriver ignores the requests to shut down, and counts the kills.
+type hungDriver struct {
+	fakedriver.Driver
+	stops, kills int
+}
+
+func (d *hungDriver) Stop() error {
+	d.stops++
+	return nil
+}
+
+func (d *hungDriver) Kill() error {
+	d.kills++
+	return d.Driver.Kill()
+}
+
+func TestStopWithTimeoutKillsHungMachine(t *testing.T) {
+	defer func(interval time.Duration) { stopPollInterval = interval }(stopPollInterval)
+	stopPollInterval = 10 * time.Millisecond
+
+	driver := &hungDriver{Driver: fakedriver.Driver{MockState: state.Running}}
+	host := &Host{Name: "box", Driver: driver}
+
+	if err := host.StopWithTimeout(50 * time.Millisecond); err != nil {
+		t.Fatalf("Expected no error but got one: %s", err)
+	}
+
+	if driver.stops != 1 || driver.kills != 1 {
+		t.Fatalf("Expected one stop and one kill, got %d and %d", driver.stops, driver.kills)
+	}
+}
+
+func TestStopWithTimeoutStopsCleanly(t *testing.T) {
+	driver := &fakedriver.Driver{MockState: state.Running}
+	host := &Host{Name: "box", Driver: driver}
+
+	if err := host.StopWithTimeout(time.Second); err != nil {
+		t.Fatalf("Expected no error but got one: %s", err)
+	}
+
+	if driver.MockState != state.Stopped {
+		t.Fatalf("Expected the machine to be stopped, got %s", driver.MockState)
+	}
+}
+
+func TestStopWithoutTimeoutKills(t *testing.T) {
+	driver := &hungDriver{Driver: fakedriver.Driver{MockState: state.Running}}
+	host := &Host{Name: "box", Driver: driver}
+
+	if err := host.StopWithTimeout(0); err != nil {
+		t.Fatalf("Expected no error but got one: %s", err)
+	}
+
+	if driver.stops != 0 || driver.kills != 1 {
+		t.Fatalf("Expected no stop and one kill, got %d and %d", driver.stops, driver.kills)
+	}
+}
+
+// versionedProvisioner installs versions of podman without a machine.
+type versionedProvisioner struct {
+	provision.FakeProvisioner
+	version string
+}
+
+func (p *versionedProvisioner) PackageVersion(name string) (string, error) {
+	return p.version, nil
+}
+
+func (p *versionedProvisioner) InstallPackageVersion(name, version string) error {
+	p.version = version
+	return nil
+}
+
+func TestUpgradeToAndRollback(t *testing.T) {
+	provisioner := &versionedProvisioner{version: "4.3.1"}
+
+	defer provision.SetDetector(&provision.StandardDetector{})
+	provision.SetDetector(&provision.FakeDetector{
+		Provisioner: provisioner,
+	})
+
+	host := &Host{
+		Driver: &fakedriver.Driver{
+			MockState: state.Running,
+		},
+		HostOptions: &Options{},
+	}
+
+	if err := host.Rollback(); err == nil {
+		t.Fatal("Expected an error rolling back a machine which was never upgraded")
+	}
+
+	if err := host.UpgradeTo("4.4.1"); err != nil {
+		t.Fatalf("Expected no error but got one: %s", err)
+	}
+
+	if host.HostOptions.EngineVersion != "4.4.1" || host.HostOptions.PreviousEngineVersion != "4.3.1" {
+		t.Fatalf("Unexpected versions after upgrade: %q, previous %q", host.HostOptions.EngineVersion, host.HostOptions.PreviousEngineVersion)
+	}
+
+	if err := host.Rollback(); err != nil {
+		t.Fatalf("Expected no error but got one: %s", err)
+	}
+
+	if provisioner.version != "4.3.1" {
+		t.Fatalf("Expected podman 4.3.1 after rollback, got %s", provisioner.version)
+	}
+
+	if host.HostOptions.EngineVersion != "4.3.1" || host.HostOptions.PreviousEngineVersion != "4.4.1" {
+		t.Fatalf("Unexpected versions after rollback: %q, previous %q", host.HostOptions.EngineVersion, host.HostOptions.PreviousEngineVersion)
+	}
+}
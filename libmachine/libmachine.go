@@ -18,7 +18,6 @@ import (
 	"github.com/thelonelyghost/p2box/libmachine/mcnerror"
 	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
 	"github.com/thelonelyghost/p2box/libmachine/persist"
-	"github.com/thelonelyghost/p2box/libmachine/provision"
 	"github.com/thelonelyghost/p2box/libmachine/ssh"
 	"github.com/thelonelyghost/p2box/libmachine/state"
 	"github.com/thelonelyghost/p2box/libmachine/version"
@@ -156,7 +155,7 @@ func (api *Client) performCreate(h *host.Host) error {
 	}
 
 	log.Info("Detecting operating system of created instance...")
-	provisioner, err := provision.DetectProvisioner(h.Driver)
+	provisioner, err := h.DetectProvisioner()
 	if err != nil {
 		return fmt.Errorf("Error detecting OS: %s", err)
 	}
@@ -166,6 +165,10 @@ func (api *Client) performCreate(h *host.Host) error {
 		return fmt.Errorf("Error running provisioning: %s", err)
 	}
 
+	if err := h.RunUserProvisioning(provisioner); err != nil {
+		return fmt.Errorf("Error running provisioning: %s", err)
+	}
+
 	// We should check the connection to podman here
 	log.Info("Checking connection to Podman...")
 	client, err := h.CreateSSHClient()
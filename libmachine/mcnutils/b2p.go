@@ -3,7 +3,6 @@ package mcnutils
 import (
 	"archive/tar"
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,9 +14,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/thelonelyghost/p2box/libmachine/log"
-	"github.com/thelonelyghost/p2box/version"
 )
 
 const (
@@ -30,6 +29,13 @@ const (
 
 var (
 	GithubAPIToken string
+
+	// DefaultProxy is the proxy of the settings file, used when no other
+	// is given. The driver plugins get it from the environment.
+	DefaultProxy = os.Getenv("MACHINE_PROXY")
+
+	// proxy picks the proxy used for downloads, see ConfigureProxy
+	proxy = http.ProxyFromEnvironment
 )
 
 var (
@@ -40,10 +46,62 @@ func defaultTimeout(network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
 
+// ConfigureProxy sets the proxy used for downloads from the value of the
+// engine-proxy flag: "auto" for the proxy environment variables, "none" for
+// a direct connection, or else the URL of the proxy. Empty is DefaultProxy,
+// or "auto" without one.
+func ConfigureProxy(value string) error {
+	if value == "" {
+		value = DefaultProxy
+	}
+
+	switch value {
+	case "", "auto":
+		proxy = http.ProxyFromEnvironment
+	case "none":
+		proxy = nil
+	default:
+		proxyURL, err := url.Parse(value)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("Invalid proxy %q, expected auto, none or a URL such as http://proxy:3128", value)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return nil
+}
+
+// ConfigureHostProxy sets the proxy used for downloads from the proxies a
+// machine was created with, for the downloads after its creation. A machine
+// created without a proxy uses the default one.
+func ConfigureHostProxy(httpProxy, httpsProxy string) error {
+	if httpProxy == "" && httpsProxy == "" {
+		return ConfigureProxy("")
+	}
+
+	proxyURLs := map[string]*url.URL{}
+	for scheme, value := range map[string]string{"http": httpProxy, "https": httpsProxy} {
+		if value == "" {
+			continue
+		}
+		proxyURL, err := url.Parse(value)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("Invalid proxy %q of the machine, expected a URL such as http://proxy:3128", value)
+		}
+		proxyURLs[scheme] = proxyURL
+	}
+
+	proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyURLs[req.URL.Scheme], nil
+	}
+
+	return nil
+}
+
 func getClient() *http.Client {
 	transport := http.Transport{
 		DisableKeepAlives: true,
-		Proxy:             http.ProxyFromEnvironment,
+		Proxy:             proxy,
 		Dial:              defaultTimeout,
 	}
 
@@ -73,8 +131,9 @@ type releaseGetter interface {
 	getReleaseTag(apiURL string) (string, error)
 	// getReleaseURL gets the latest release download URL from the given URL.
 	getReleaseURL(apiURL string) (string, error)
-	// download downloads a file from the given dlURL and saves it under dir.
-	download(dir, file, dlURL string) error
+	// download downloads a file from the given dlURL, saves it under dir
+	// and returns its sha256 digest.
+	download(dir, file, dlURL string) (string, error)
 }
 
 // b2pReleaseGetter implements the releaseGetter interface for getting the release of Boot2Podman.
@@ -89,139 +148,113 @@ func (b *b2pReleaseGetter) filename() string {
 	return b.isoFilename
 }
 
-// getReleaseTag gets the release tag of Boot2Podman from apiURL.
-func (*b2pReleaseGetter) getReleaseTag(apiURL string) (string, error) {
+// releaseSourceFor returns where the releases are found: the github releases
+// API apiURL when given, or else the configured release source.
+func releaseSourceFor(apiURL string) (releaseSource, error) {
 	if apiURL == "" {
-		apiURL = defaultURL
-	}
-
-	if !version.RC() {
-		// Just go straight to the convenience URL for "/latest" if we
-		// are a non-release candidate version.  "/latest" won't return
-		// non-RCs, so that's what we use for stable releases of
-		// Machine.
-		apiURL = apiURL + "/latest"
+		return newReleaseSource(ReleaseSource)
 	}
+	return &githubSource{apiURL: apiURL}, nil
+}
 
-	client := getClient()
-	req, err := getRequest(apiURL)
-	if err != nil {
-		return "", err
-	}
-	rsp, err := client.Do(req)
+// getReleaseTag gets the release tag of Boot2Podman from apiURL.
+func (*b2pReleaseGetter) getReleaseTag(apiURL string) (string, error) {
+	source, err := releaseSourceFor(apiURL)
 	if err != nil {
 		return "", err
 	}
-	defer rsp.Body.Close()
 
-	// If we call the API endpoint
-	// "/repos/boot2podman/boot2podman/releases" without specifying
-	// "/latest", we will receive a list of releases instead of a single
-	// one, and we should decode accordingly.
-	if version.RC() {
-		var tags []struct {
-			TagName string `json:"tag_name"`
-		}
-		if err := json.NewDecoder(rsp.Body).Decode(&tags); err != nil {
-			return "", err
-		}
-		t := tags[0]
-		if t.TagName == "" {
-			return "", errGitHubAPIResponse
+	return source.latestTag()
+}
+
+// getReleaseURL gets the latest release URL of Boot2Podman.
+func (b *b2pReleaseGetter) getReleaseURL(apiURL string) (string, error) {
+	if apiURL != "" {
+		if _, _, _, _, ok := parseGithubReleasesURL(apiURL); !ok {
+			// does not match a github releases api URL
+			return apiURL, nil
 		}
-		return t.TagName, nil
 	}
 
-	// Otherwise, we get back just one release, which we can decode to get
-	// the tag.
-	var t struct {
-		TagName string `json:"tag_name"`
-	}
-	if err := json.NewDecoder(rsp.Body).Decode(&t); err != nil {
+	source, err := releaseSourceFor(apiURL)
+	if err != nil {
 		return "", err
 	}
-	if t.TagName == "" {
-		return "", errGitHubAPIResponse
-	}
-	return t.TagName, nil
-}
 
-// getReleaseURL gets the latest release URL of Boot2Podman.
-func (b *b2pReleaseGetter) getReleaseURL(apiURL string) (string, error) {
-	if apiURL == "" {
-		apiURL = defaultURL
+	tag, err := source.latestTag()
+	if err != nil {
+		return "", err
 	}
 
-	// match github (enterprise) release urls:
-	// https://api.github.com/repos/../../releases or
-	// https://some.github.enterprise/api/v3/repos/../../releases
+	log.Infof("Latest release for %s is %s", source, tag)
+	return source.isoURL(tag, b.isoFilename)
+}
+
+// parseGithubReleasesURL splits a github (enterprise) releases api URL:
+// https://api.github.com/repos/../../releases or
+// https://some.github.enterprise/api/v3/repos/../../releases
+func parseGithubReleasesURL(apiURL string) (scheme, host, org, repo string, ok bool) {
 	re := regexp.MustCompile("(https?)://([^/]+)(/api/v3)?/repos/([^/]+)/([^/]+)/releases")
 	matches := re.FindStringSubmatch(apiURL)
 	if len(matches) != 6 {
-		// does not match a github releases api URL
-		return apiURL, nil
+		return "", "", "", "", false
 	}
 
-	scheme, host, org, repo := matches[1], matches[2], matches[4], matches[5]
+	scheme, host, org, repo = matches[1], matches[2], matches[4], matches[5]
 	if host == "api.github.com" {
 		host = "github.com"
 	}
 
-	tag, err := b.getReleaseTag(apiURL)
+	return scheme, host, org, repo, true
+}
+
+// download copies the file at isoURL under dir, verifying it against the
+// checksum file published next to it, if any. Downloads go to a .tmp file
+// first, which is kept when they fail so the next attempt resumes it.
+func (*b2pReleaseGetter) download(dir, file, isoURL string) (string, error) {
+	u, err := url.Parse(isoURL)
 	if err != nil {
 		return "", err
 	}
 
-	log.Infof("Latest release for %s/%s/%s is %s", host, org, repo, tag)
-	url := fmt.Sprintf("%s://%s/%s/%s/releases/download/%s/%s", scheme, host, org, repo, tag, b.isoFilename)
-	return url, nil
-}
-
-func (*b2pReleaseGetter) download(dir, file, isoURL string) error {
-	u, err := url.Parse(isoURL)
+	partial := filepath.Join(dir, file+".tmp")
+	tmp, err := claimPartial(partial)
+	if err != nil {
+		return "", err
+	}
+	// what is left of tmp on return is not worth resuming
+	defer removePartial(tmp)
 
-	var src io.ReadCloser
 	if u.Scheme == "file" || u.Scheme == "" {
-		s, err := os.Open(u.Path)
-		if err != nil {
-			return err
-		}
-
-		src = s
-	} else {
-		client := getClient()
-		s, err := client.Get(isoURL)
-		if err != nil {
-			return err
+		if err := CopyFile(u.Path, tmp); err != nil {
+			return "", err
 		}
-
-		src = &ReaderWithProgress{
-			ReadCloser:     s.Body,
-			out:            os.Stdout,
-			expectedLength: s.ContentLength,
+	} else if err := fetchWithRetries(tmp, isoURL); err != nil {
+		if _, ok := err.(*permanentError); !ok {
+			keepPartial(tmp, partial)
 		}
+		return "", err
 	}
 
-	defer src.Close()
-
-	// Download to a temp file first then rename it to avoid partial download.
-	f, err := ioutil.TempFile(dir, file+".tmp")
+	digest, err := fileDigest(tmp)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	defer func() {
-		if err := removeFileIfExists(f.Name()); err != nil {
-			log.Warnf("Error removing file: %s", err)
-		}
-	}()
-
-	if _, err := io.Copy(f, src); err != nil {
-		return err
+	expected, err := releaseChecksum(isoURL)
+	if err != nil {
+		keepPartial(tmp, partial)
+		return "", fmt.Errorf("Error fetching the checksum of %s: %s", isoURL, err)
 	}
 
-	if err := f.Close(); err != nil {
-		return err
+	if expected == "" {
+		log.Debugf("No checksum published for %s", isoURL)
+	} else {
+		// a damaged download must not be resumed
+		if err := checkDigest(isoURL, expected, digest); err != nil {
+			return "", err
+		}
+		log.Debugf("Verified the checksum of %s", isoURL)
 	}
 
 	// Dest is the final path of the boot2podman.iso file.
@@ -230,10 +263,10 @@ func (*b2pReleaseGetter) download(dir, file, isoURL string) error {
 	// Windows can't rename in place, so remove the old file before
 	// renaming the temporary downloaded file.
 	if err := removeFileIfExists(dest); err != nil {
-		return err
+		return "", err
 	}
 
-	return os.Rename(f.Name(), dest)
+	return digest, os.Rename(tmp, dest)
 }
 
 // iso is an ISO volume.
@@ -340,7 +373,22 @@ func NewB2pUtils(storePath string) *B2pUtils {
 // DownloadISO downloads boot2podman ISO image for the given tag and save it at dest.
 func (b *B2pUtils) DownloadISO(dir, file, isoURL string) error {
 	log.Infof("Downloading %s from %s...", b.path(), isoURL)
-	return b.download(dir, file, isoURL)
+	return b.downloadFile(dir, file, isoURL)
+}
+
+// downloadFile downloads a file, recording its digest when it goes to the
+// image cache.
+func (b *B2pUtils) downloadFile(dir, file, dlURL string) error {
+	digest, err := b.download(dir, file, dlURL)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Clean(dir) != filepath.Clean(b.imgCachePath) {
+		return nil
+	}
+
+	return recordDigest(filepath.Join(dir, file), digest)
 }
 
 type ReaderWithProgress struct {
@@ -349,18 +397,78 @@ type ReaderWithProgress struct {
 	bytesTransferred   int64
 	expectedLength     int64
 	nextPercentToPrint int64
+	// resumedBytes were downloaded by an earlier attempt, they do not
+	// count in the download rate
+	resumedBytes int64
+	started      time.Time
+	// now is time.Now, but for the tests
+	now func() time.Time
+}
+
+// newReaderWithProgress prints the progress of a download of expectedLength
+// bytes, resumed after the given number of bytes.
+func newReaderWithProgress(rc io.ReadCloser, out io.Writer, resumedBytes, expectedLength int64) *ReaderWithProgress {
+	r := &ReaderWithProgress{
+		ReadCloser:       rc,
+		out:              out,
+		bytesTransferred: resumedBytes,
+		expectedLength:   expectedLength,
+		resumedBytes:     resumedBytes,
+	}
+
+	// a resumed download starts with the progress it had made
+	if expectedLength > 0 {
+		percentage := resumedBytes * 100 / expectedLength
+		r.nextPercentToPrint = percentage - percentage%2
+	}
+
+	return r
+}
+
+func (r *ReaderWithProgress) clock() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+	return r.now()
+}
+
+// eta estimates the time left from the download rate so far.
+func (r *ReaderWithProgress) eta() (time.Duration, bool) {
+	elapsed := r.clock().Sub(r.started)
+	downloaded := r.bytesTransferred - r.resumedBytes
+	if elapsed <= 0 || downloaded <= 0 {
+		return 0, false
+	}
+
+	rate := float64(downloaded) / elapsed.Seconds()
+	left := time.Duration(float64(r.expectedLength-r.bytesTransferred) / rate * float64(time.Second))
+
+	return left.Round(time.Second), true
 }
 
 func (r *ReaderWithProgress) Read(p []byte) (int, error) {
+	if r.started.IsZero() {
+		r.started = r.clock()
+	}
+
 	n, err := r.ReadCloser.Read(p)
 
-	if n > 0 {
+	// without a length, there is no progress to print
+	if n > 0 && r.expectedLength > 0 {
 		r.bytesTransferred += int64(n)
 		percentage := r.bytesTransferred * 100 / r.expectedLength
 
+		eta, hasEta := time.Duration(0), false
+		if percentage >= r.nextPercentToPrint {
+			eta, hasEta = r.eta()
+		}
+
 		for percentage >= r.nextPercentToPrint {
 			if r.nextPercentToPrint%10 == 0 {
 				fmt.Fprintf(r.out, "%d%%", r.nextPercentToPrint)
+				if hasEta && r.nextPercentToPrint > 0 && r.nextPercentToPrint < 100 {
+					fmt.Fprintf(r.out, " (%s left)", eta)
+				}
 			} else if r.nextPercentToPrint%2 == 0 {
 				fmt.Fprint(r.out, ".")
 			}
@@ -414,6 +522,12 @@ func (b *B2pUtils) UpdateISOCache(isoURL string) error {
 		return b.DownloadLatestBoot2Podman("")
 	}
 
+	// the cached ISO is the latest one there is offline
+	if Offline {
+		log.Debug("Offline, using the cached Boot2Podman ISO")
+		return nil
+	}
+
 	latest := b.isLatest()
 	if !latest {
 		log.Info("Default Boot2Podman ISO is out-of-date, downloading the latest release...")
@@ -435,7 +549,15 @@ func (b *B2pUtils) CopyIsoToMachineDir(isoURL, machineName string) error {
 	// By default just copy the existing "cached" iso to the machine's directory...
 	if isoURL == "" {
 		log.Infof("Copying %s to %s...", b.path(), machineIsoPath)
-		return CopyFile(b.path(), machineIsoPath)
+		if err := CopyFile(b.path(), machineIsoPath); err != nil {
+			return err
+		}
+
+		// the cached ISO may have been damaged since it was downloaded
+		if digest := recordedDigest(b.path()); digest != "" {
+			return b.VerifyMachineIso(machineName, "sha256:"+digest)
+		}
+		return nil
 	}
 
 	// if ISO is specified, check if it matches a github releases url or fallback to a direct download
@@ -447,6 +569,170 @@ func (b *B2pUtils) CopyIsoToMachineDir(isoURL, machineName string) error {
 	return b.DownloadISO(machineDir, b.filename(), downloadURL)
 }
 
+// taggedReleaseURL returns the download URL of the ISO of the release with
+// the given tag, which only github releases and mirrors have.
+func (b *B2pUtils) taggedReleaseURL(apiURL, tag string) (string, error) {
+	source, err := releaseSourceFor(apiURL)
+	if err != nil {
+		return "", err
+	}
+
+	return source.isoURL(tag, b.filename())
+}
+
+func (b *B2pUtils) machineIsoPath(machineName string) string {
+	return filepath.Join(b.storePath, "machines", machineName, b.filename())
+}
+
+// previousIsoPath is where the ISO of a machine is kept by an upgrade, so
+// that it can be rolled back.
+func (b *B2pUtils) previousIsoPath(machineName string) string {
+	return strings.TrimSuffix(b.machineIsoPath(machineName), ".iso") + "-previous.iso"
+}
+
+// UpgradeMachineIso replaces the ISO of a machine with the release of the
+// given tag, or the latest one when empty, keeping the previous ISO for
+// RollbackMachineIso.
+func (b *B2pUtils) UpgradeMachineIso(isoURL, tag, machineName string) error {
+	if err := b.FetchMachineIso(isoURL, tag, machineName); err != nil {
+		return err
+	}
+
+	return b.InstallMachineIso(machineName)
+}
+
+// FetchMachineIso copies or downloads the release of the given tag, or the
+// latest one when empty, next to the ISO of a machine for InstallMachineIso,
+// so that the machine can keep running meanwhile and a failed fetch leaves
+// its ISO in place.
+func (b *B2pUtils) FetchMachineIso(isoURL, tag, machineName string) error {
+	upgrade := b.upgradeIsoPath(machineName)
+	if err := b.fetchMachineIso(isoURL, tag, upgrade); err != nil {
+		if err := removeFileIfExists(upgrade); err != nil {
+			log.Warnf("Error removing file: %s", err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// InstallMachineIso replaces the ISO of a machine with the one fetched by
+// FetchMachineIso, keeping the previous ISO for RollbackMachineIso.
+func (b *B2pUtils) InstallMachineIso(machineName string) error {
+	current := b.machineIsoPath(machineName)
+	upgrade := b.upgradeIsoPath(machineName)
+
+	if _, err := os.Stat(upgrade); err != nil {
+		return fmt.Errorf("No ISO fetched for %q: %s", machineName, err)
+	}
+
+	if _, err := os.Stat(current); err == nil {
+		log.Infof("Keeping the previous ISO as %s...", b.previousIsoPath(machineName))
+		if err := os.Rename(current, b.previousIsoPath(machineName)); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(upgrade, current)
+}
+
+// upgradeIsoPath is where the ISO of a machine is fetched to by an upgrade.
+func (b *B2pUtils) upgradeIsoPath(machineName string) string {
+	return strings.TrimSuffix(b.machineIsoPath(machineName), ".iso") + "-upgrade.iso"
+}
+
+// fetchMachineIso copies or downloads the release of the given tag, or the
+// latest one when empty, to dest.
+func (b *B2pUtils) fetchMachineIso(isoURL, tag, dest string) error {
+	// releases of the default ISO are cached, so they can be pulled
+	// beforehand for offline use
+	if isoURL == "" {
+		cachedIso := b.path()
+		if tag == "" {
+			if err := b.UpdateISOCache(""); err != nil {
+				return err
+			}
+		} else {
+			var err error
+			if cachedIso, err = b.CacheTaggedIso(tag); err != nil {
+				return err
+			}
+		}
+
+		log.Infof("Copying %s to %s...", cachedIso, dest)
+		if err := CopyFile(cachedIso, dest); err != nil {
+			return err
+		}
+
+		// the cached ISO may have been damaged since it was downloaded
+		if digest := recordedDigest(cachedIso); digest != "" {
+			return VerifyChecksum(dest, "sha256:"+digest)
+		}
+		return nil
+	}
+
+	var downloadURL string
+	var err error
+	if tag == "" {
+		downloadURL, err = b.getReleaseURL(isoURL)
+	} else {
+		downloadURL, err = b.taggedReleaseURL(isoURL, tag)
+	}
+	if err != nil {
+		return err
+	}
+
+	return b.DownloadISO(filepath.Dir(dest), filepath.Base(dest), downloadURL)
+}
+
+// RollbackMachineIso swaps the ISO of a machine with the one it had before
+// its last upgrade, so rolling back twice returns to the upgraded ISO.
+func (b *B2pUtils) RollbackMachineIso(machineName string) error {
+	current := b.machineIsoPath(machineName)
+	previous := b.previousIsoPath(machineName)
+
+	if _, err := os.Stat(previous); err != nil {
+		return fmt.Errorf("No previous ISO to roll back to for %q: %s", machineName, err)
+	}
+
+	swap := current + ".swap"
+	if err := os.Rename(current, swap); err != nil {
+		return err
+	}
+	if err := os.Rename(previous, current); err != nil {
+		return err
+	}
+
+	return os.Rename(swap, previous)
+}
+
+// VerifyMachineIso makes sure the ISO of a machine has the given
+// sha256:DIGEST checksum, removing it otherwise so it is not booted.
+func (b *B2pUtils) VerifyMachineIso(machineName, checksum string) error {
+	machineIso := b.machineIsoPath(machineName)
+	if err := VerifyChecksum(machineIso, checksum); err != nil {
+		if err := os.Remove(machineIso); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Error removing file: %s", err)
+		}
+		return err
+	}
+
+	log.Infof("Verified the checksum of %s", machineIso)
+	return nil
+}
+
+// MachineIsoVersion returns the release tag of the ISO of a machine.
+func (b *B2pUtils) MachineIsoVersion(machineName string) (string, error) {
+	machineIso := &b2pISO{
+		commonIsoPath:  b.machineIsoPath(machineName),
+		volumeIDOffset: defaultVolumeIDOffset,
+		volumeIDLength: defaultVolumeIDLength,
+	}
+
+	return machineIso.version()
+}
+
 // isLatest checks the latest release tag and
 // reports whether the local ISO cache is the latest version.
 //
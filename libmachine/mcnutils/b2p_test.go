@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/thelonelyghost/p2box/libmachine/log"
 	"github.com/thelonelyghost/p2box/version"
@@ -159,23 +160,50 @@ func TestReaderWithProgress(t *testing.T) {
 	output := new(bytes.Buffer)
 	buffer := make([]byte, 100)
 
-	readerWithProgress := ReaderWithProgress{
-		ReadCloser:     &readCloser,
-		out:            output,
-		expectedLength: 100,
+	// every look at the clock is one second later
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
 	}
 
+	readerWithProgress := newReaderWithProgress(&readCloser, output, 0, 100)
+	readerWithProgress.now = clock
+
 	readerWithProgress.Read(buffer)
 	assert.Equal(t, "0%..", output.String())
 
 	readerWithProgress.Read(buffer)
-	assert.Equal(t, "0%....10%....20%....30%....40%....50%", output.String())
+	assert.Equal(t, "0%....10% (2s left)....20% (2s left)....30% (2s left)....40% (2s left)....50% (2s left)", output.String())
 
+	output.Reset()
 	readerWithProgress.Read(buffer)
-	assert.Equal(t, "0%....10%....20%....30%....40%....50%....60%....70%....80%....90%....100%", output.String())
+	assert.Equal(t, "....60% (0s left)....70% (0s left)....80% (0s left)....90% (0s left)....100%", output.String())
 
 	readerWithProgress.Close()
-	assert.Equal(t, "0%....10%....20%....30%....40%....50%....60%....70%....80%....90%....100%\n", output.String())
+	assert.Equal(t, "....60% (0s left)....70% (0s left)....80% (0s left)....90% (0s left)....100%\n", output.String())
+}
+
+func TestReaderWithProgressResumed(t *testing.T) {
+	readCloser := MockReadCloser{blockLengths: []int{10}}
+	output := new(bytes.Buffer)
+
+	readerWithProgress := newReaderWithProgress(&readCloser, output, 41, 100)
+	readerWithProgress.Read(make([]byte, 100))
+
+	assert.Contains(t, output.String(), "40%")
+	assert.NotContains(t, output.String(), "30%")
+	assert.Contains(t, output.String(), "50%")
+}
+
+func TestReaderWithProgressUnknownLength(t *testing.T) {
+	readCloser := MockReadCloser{blockLengths: []int{10}}
+	output := new(bytes.Buffer)
+
+	readerWithProgress := newReaderWithProgress(&readCloser, output, 0, -1)
+	readerWithProgress.Read(make([]byte, 100))
+
+	assert.Equal(t, "", output.String())
 }
 
 type mockReleaseGetter struct {
@@ -196,7 +224,7 @@ func (m *mockReleaseGetter) getReleaseURL(apiURL string) (string, error) {
 	return "http://127.0.0.1/dummy", m.apiErr
 }
 
-func (m *mockReleaseGetter) download(dir, file, isoURL string) error {
+func (m *mockReleaseGetter) download(dir, file, isoURL string) (string, error) {
 	path := filepath.Join(dir, file)
 	var err error
 	if _, e := os.Stat(path); os.IsNotExist(e) {
@@ -205,7 +233,10 @@ func (m *mockReleaseGetter) download(dir, file, isoURL string) error {
 
 	// send a signal of downloading the latest version
 	m.verCh <- m.ver
-	return err
+	if err != nil {
+		return "", err
+	}
+	return fileDigest(path)
 }
 
 type mockISO struct {
@@ -339,3 +370,156 @@ func newDummyISO(dir, name, version string) (string, int64, error) {
 func dummyISOData(padding, version string) []byte {
 	return []byte(fmt.Sprintf("%sBoot2Podman-%s                    ", padding, version))
 }
+
+func TestConfigureProxy(t *testing.T) {
+	defer ConfigureProxy("")
+
+	req, _ := http.NewRequest("GET", "https://github.com", nil)
+
+	assert.NoError(t, ConfigureProxy("http://proxy:3128"))
+	proxyURL, err := proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", proxyURL.String())
+
+	assert.NoError(t, ConfigureProxy("none"))
+	assert.Nil(t, proxy)
+
+	assert.Error(t, ConfigureProxy("proxy:3128"))
+}
+
+func TestConfigureProxyDefault(t *testing.T) {
+	defer func(value string) {
+		DefaultProxy = value
+		ConfigureProxy("")
+	}(DefaultProxy)
+
+	req, _ := http.NewRequest("GET", "https://github.com", nil)
+
+	DefaultProxy = "http://proxy:3128"
+	assert.NoError(t, ConfigureProxy(""))
+	proxyURL, err := proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", proxyURL.String())
+
+	assert.NoError(t, ConfigureProxy("none"))
+	assert.Nil(t, proxy)
+}
+
+func TestConfigureHostProxy(t *testing.T) {
+	defer ConfigureProxy("")
+
+	httpReq, _ := http.NewRequest("GET", "http://mirror.internal/boot2podman.iso", nil)
+	httpsReq, _ := http.NewRequest("GET", "https://github.com", nil)
+
+	assert.NoError(t, ConfigureHostProxy("http://proxy:3128", "http://secure-proxy:3128"))
+	proxyURL, err := proxy(httpReq)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", proxyURL.String())
+	proxyURL, err = proxy(httpsReq)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://secure-proxy:3128", proxyURL.String())
+
+	assert.NoError(t, ConfigureHostProxy("http://proxy:3128", ""))
+	proxyURL, err = proxy(httpsReq)
+	assert.NoError(t, err)
+	assert.Nil(t, proxyURL)
+
+	assert.Error(t, ConfigureHostProxy("proxy:3128", ""))
+}
+
+func TestTaggedReleaseURL(t *testing.T) {
+	b := NewB2pUtils("")
+
+	isoURL, err := b.taggedReleaseURL("", "v0.18")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/boot2podman/boot2podman/releases/download/v0.18/boot2podman.iso", isoURL)
+
+	isoURL, err = b.taggedReleaseURL("https://github.example.com/api/v3/repos/org/repo/releases", "v1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/org/repo/releases/download/v1.0/boot2podman.iso", isoURL)
+
+	_, err = b.taggedReleaseURL("http://mirror.internal/boot2podman.iso", "v1.0")
+	assert.Error(t, err)
+}
+
+func TestRollbackMachineIso(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	assert.Error(t, b.RollbackMachineIso("box"))
+
+	machineDir := filepath.Join(storePath, "machines", "box")
+	os.MkdirAll(machineDir, 0700)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman.iso"), dummyISOData("", "v0.19"), 0644)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman-previous.iso"), dummyISOData("", "v0.18"), 0644)
+
+	b.iso = &b2pISO{commonIsoPath: filepath.Join(machineDir, "boot2podman.iso"), volumeIDLength: defaultVolumeIDLength}
+	assert.NoError(t, b.RollbackMachineIso("box"))
+
+	ver, err := b.version()
+	assert.NoError(t, err)
+	assert.Equal(t, "v0.18", ver)
+
+	previous, _ := ioutil.ReadFile(filepath.Join(machineDir, "boot2podman-previous.iso"))
+	assert.Equal(t, dummyISOData("", "v0.19"), previous)
+}
+
+func TestUpgradeMachineIso(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	machineDir := filepath.Join(storePath, "machines", "box")
+	os.MkdirAll(machineDir, 0700)
+	os.MkdirAll(b.imgCachePath, 0700)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman.iso"), dummyISOData("", "v0.19"), 0644)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman-previous.iso"), dummyISOData("", "v0.18"), 0644)
+	ioutil.WriteFile(filepath.Join(b.imgCachePath, "boot2podman-v0.20.iso"), dummyISOData("", "v0.20"), 0644)
+
+	// a failed upgrade keeps both ISOs
+	assert.Error(t, b.UpgradeMachineIso("http://mirror.internal/boot2podman.iso", "v0.21", "box"))
+
+	current, _ := ioutil.ReadFile(filepath.Join(machineDir, "boot2podman.iso"))
+	assert.Equal(t, dummyISOData("", "v0.19"), current)
+	previous, _ := ioutil.ReadFile(filepath.Join(machineDir, "boot2podman-previous.iso"))
+	assert.Equal(t, dummyISOData("", "v0.18"), previous)
+
+	assert.NoError(t, b.UpgradeMachineIso("", "v0.20", "box"))
+
+	current, _ = ioutil.ReadFile(filepath.Join(machineDir, "boot2podman.iso"))
+	assert.Equal(t, dummyISOData("", "v0.20"), current)
+	previous, _ = ioutil.ReadFile(filepath.Join(machineDir, "boot2podman-previous.iso"))
+	assert.Equal(t, dummyISOData("", "v0.19"), previous)
+
+	_, err = os.Stat(filepath.Join(machineDir, "boot2podman-upgrade.iso"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInstallMachineIsoNeedsFetch(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	machineDir := filepath.Join(storePath, "machines", "box")
+	os.MkdirAll(machineDir, 0700)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman.iso"), dummyISOData("", "v0.19"), 0644)
+
+	assert.Error(t, b.FetchMachineIso("http://mirror.internal/boot2podman.iso", "v0.21", "box"))
+	assert.Error(t, b.InstallMachineIso("box"))
+
+	current, _ := ioutil.ReadFile(filepath.Join(machineDir, "boot2podman.iso"))
+	assert.Equal(t, dummyISOData("", "v0.19"), current)
+}
@@ -0,0 +1,158 @@
+package mcnutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+// CachedImage is an ISO or a base image in the image cache.
+type CachedImage struct {
+	Name string
+	Path string
+	// Version is the release of an ISO, empty for base images
+	Version string
+	// Digest is the sha256 digest of the image, empty for the images
+	// cached before digests were recorded
+	Digest  string
+	Size    int64
+	ModTime time.Time
+}
+
+// taggedIsoFilename names the cached ISO of a release, next to the default
+// ISO which is always the latest release.
+func (b *B2pUtils) taggedIsoFilename(tag string) string {
+	return fmt.Sprintf("%s-%s.iso", strings.TrimSuffix(b.filename(), ".iso"), tag)
+}
+
+// CacheTaggedIso makes sure the ISO of the release with the given tag is in
+// the image cache, downloading it if needed, and returns its path.
+func (b *B2pUtils) CacheTaggedIso(tag string) (string, error) {
+	isoPath := filepath.Join(b.imgCachePath, b.taggedIsoFilename(tag))
+
+	if _, err := os.Stat(isoPath); err == nil {
+		log.Infof("Using cached ISO %s", isoPath)
+		return isoPath, nil
+	}
+
+	if err := os.MkdirAll(b.imgCachePath, 0700); err != nil {
+		return "", err
+	}
+
+	downloadURL, err := b.taggedReleaseURL("", tag)
+	if err != nil {
+		return "", err
+	}
+
+	if err := b.DownloadISO(b.imgCachePath, filepath.Base(isoPath), downloadURL); err != nil {
+		return "", err
+	}
+
+	return isoPath, nil
+}
+
+// ListCache returns the ISOs and base images in the image cache, by name.
+func (b *B2pUtils) ListCache() ([]CachedImage, error) {
+	entries, err := ioutil.ReadDir(b.imgCachePath)
+	if os.IsNotExist(err) {
+		return []CachedImage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	images := []CachedImage{}
+	for _, entry := range entries {
+		// skip the directories, the downloads in progress and the digests
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp") || strings.HasSuffix(entry.Name(), digestSuffix) {
+			continue
+		}
+
+		image := CachedImage{
+			Name:    entry.Name(),
+			Path:    filepath.Join(b.imgCachePath, entry.Name()),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+		}
+		image.Digest = recordedDigest(image.Path)
+
+		if strings.HasSuffix(entry.Name(), ".iso") {
+			cachedIso := &b2pISO{
+				commonIsoPath:  image.Path,
+				volumeIDOffset: defaultVolumeIDOffset,
+				volumeIDLength: defaultVolumeIDLength,
+			}
+			if version, err := cachedIso.version(); err == nil {
+				image.Version = version
+			}
+		}
+
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+
+	return images, nil
+}
+
+// RemoveCachedImage removes an ISO or a base image from the image cache.
+func (b *B2pUtils) RemoveCachedImage(name string) error {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid image name %q", name)
+	}
+
+	imagePath := filepath.Join(b.imgCachePath, name)
+	if err := os.Remove(imagePath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No image %q in the cache", name)
+		}
+		return err
+	}
+
+	return removeFileIfExists(imagePath + digestSuffix)
+}
+
+// ImagesUsedBy returns the names of the cached images a machine uses, from
+// the configuration of its driver: the base image its disk is backed by, or
+// the ISOs its upgrades come from.
+func (b *B2pUtils) ImagesUsedBy(rawDriver []byte, engineVersion string) []string {
+	var d struct {
+		BaseImage string
+		// only the drivers booting an ISO have the field
+		Boot2PodmanURL *string
+	}
+	if err := json.Unmarshal(rawDriver, &d); err != nil {
+		return []string{}
+	}
+
+	if d.BaseImage != "" {
+		imagePath, err := b.BaseImagePath(d.BaseImage)
+		if err != nil {
+			return []string{}
+		}
+		// the machine may be older than the digest in the name
+		legacyPath, _ := b.legacyBaseImagePath(d.BaseImage)
+		return []string{filepath.Base(imagePath), filepath.Base(legacyPath)}
+	}
+
+	// non-default ISOs are not cached
+	if d.Boot2PodmanURL == nil || *d.Boot2PodmanURL != "" {
+		return []string{}
+	}
+
+	images := []string{b.filename()}
+	if engineVersion != "" {
+		images = append(images, b.taggedIsoFilename(engineVersion))
+	}
+
+	return images
+}
@@ -0,0 +1,92 @@
+package mcnutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListCache(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	images, err := b.ListCache()
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+
+	// the volume ID of the cached ISOs is read at its real offset
+	padding := strings.Repeat(" ", int(defaultVolumeIDOffset))
+
+	cacheDir := filepath.Join(storePath, "cache")
+	os.MkdirAll(filepath.Join(cacheDir, "subdir"), 0700)
+	ioutil.WriteFile(filepath.Join(cacheDir, "boot2podman.iso"), dummyISOData(padding, "v0.19"), 0644)
+	ioutil.WriteFile(filepath.Join(cacheDir, "boot2podman-v0.18.iso"), dummyISOData(padding, "v0.18"), 0644)
+	ioutil.WriteFile(filepath.Join(cacheDir, "fedora.qcow2"), []byte("qcow"), 0644)
+	ioutil.WriteFile(filepath.Join(cacheDir, "fedora.qcow2.tmp"), []byte("qc"), 0644)
+
+	images, err = b.ListCache()
+	assert.NoError(t, err)
+	assert.Len(t, images, 3)
+
+	assert.Equal(t, "boot2podman-v0.18.iso", images[0].Name)
+	assert.Equal(t, "v0.18", images[0].Version)
+	assert.Equal(t, "boot2podman.iso", images[1].Name)
+	assert.Equal(t, "v0.19", images[1].Version)
+	assert.Equal(t, "fedora.qcow2", images[2].Name)
+	assert.Equal(t, "", images[2].Version)
+	assert.Equal(t, int64(4), images[2].Size)
+	assert.Equal(t, filepath.Join(cacheDir, "fedora.qcow2"), images[2].Path)
+}
+
+func TestRemoveCachedImage(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	cacheDir := filepath.Join(storePath, "cache")
+	os.MkdirAll(cacheDir, 0700)
+	ioutil.WriteFile(filepath.Join(cacheDir, "fedora.qcow2"), []byte("qcow"), 0644)
+
+	assert.Error(t, b.RemoveCachedImage("../config.json"))
+	assert.Error(t, b.RemoveCachedImage(".."))
+	assert.Error(t, b.RemoveCachedImage("missing.iso"))
+
+	assert.NoError(t, b.RemoveCachedImage("fedora.qcow2"))
+	_, err = os.Stat(filepath.Join(cacheDir, "fedora.qcow2"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestImagesUsedBy(t *testing.T) {
+	b := NewB2pUtils("/tmp/store")
+
+	testCases := []struct {
+		description   string
+		rawDriver     string
+		engineVersion string
+		expected      []string
+	}{
+		{"base image", `{"BaseImage": "https://example.com/images/fedora.qcow2"}`, "", []string{"01c99e570a6f-fedora.qcow2", "fedora.qcow2"}},
+		{"default ISO", `{"Boot2PodmanURL": ""}`, "", []string{"boot2podman.iso"}},
+		{"upgraded ISO", `{"Boot2PodmanURL": ""}`, "v0.18", []string{"boot2podman.iso", "boot2podman-v0.18.iso"}},
+		{"custom ISO", `{"Boot2PodmanURL": "file:///tmp/custom.iso"}`, "", []string{}},
+		{"no image", `{"CPU": 2}`, "", []string{}},
+		{"invalid", `not json`, "", []string{}},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, b.ImagesUsedBy([]byte(tc.rawDriver), tc.engineVersion), tc.description)
+	}
+}
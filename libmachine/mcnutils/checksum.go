@@ -0,0 +1,187 @@
+package mcnutils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+// checksumFilename is the file releases publish the digests of their
+// artifacts in, next to them
+const checksumFilename = "sha256sum.txt"
+
+// digestSuffix is the extension of the file recording the digest of an
+// image in the cache
+const digestSuffix = ".sha256"
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ParseChecksum reads a checksum given as sha256:DIGEST, and returns the
+// digest.
+func ParseChecksum(value string) (string, error) {
+	i := strings.Index(value, ":")
+	if i < 0 || value[:i] != "sha256" || !sha256Pattern.MatchString(strings.ToLower(value[i+1:])) {
+		return "", fmt.Errorf("Invalid checksum %q, expected sha256:DIGEST with a 64 character hex digest", value)
+	}
+
+	return strings.ToLower(value[i+1:]), nil
+}
+
+// fileDigest returns the sha256 digest of a file.
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkDigest compares the digest of a file to the expected one.
+func checkDigest(file, expected, actual string) error {
+	if expected != actual {
+		return fmt.Errorf("Checksum mismatch for %s: expected sha256:%s, got sha256:%s. The file may be truncated or tampered with", file, expected, actual)
+	}
+
+	return nil
+}
+
+// VerifyChecksum makes sure a file has the given sha256:DIGEST checksum.
+func VerifyChecksum(file, checksum string) error {
+	expected, err := ParseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	actual, err := fileDigest(file)
+	if err != nil {
+		return fmt.Errorf("Error computing the checksum of %s: %s", file, err)
+	}
+
+	return checkDigest(file, expected, actual)
+}
+
+// parseChecksumFile finds the digest of a file in the output of sha256sum,
+// where binary mode prefixes the names with "*".
+func parseChecksumFile(r io.Reader, name string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		if path.Base(strings.TrimPrefix(fields[1], "*")) == name {
+			digest := strings.ToLower(fields[0])
+			if !sha256Pattern.MatchString(digest) {
+				return "", fmt.Errorf("Invalid digest %q for %s", fields[0], name)
+			}
+			return digest, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// releaseChecksum returns the digest published for the file at dlURL in the
+// checksum file next to it, or an empty digest when there is none. Release
+// sources publish one, so failing to fetch theirs is an error, while other
+// servers may answer anything for a file they do not have.
+func releaseChecksum(dlURL string) (string, error) {
+	u, err := url.Parse(dlURL)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(filepath.ToSlash(u.Path))
+	checksumURL := *u
+	checksumURL.Path = path.Join(path.Dir(filepath.ToSlash(u.Path)), checksumFilename)
+	checksumURL.RawPath = ""
+
+	strict := isReleaseURL(dlURL)
+
+	var src io.ReadCloser
+	if u.Scheme == "file" || u.Scheme == "" {
+		f, err := os.Open(filepath.FromSlash(checksumURL.Path))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			if !strict {
+				log.Debugf("Error reading %s: %s", checksumURL.Path, err)
+				return "", nil
+			}
+			return "", err
+		}
+
+		src = f
+	} else {
+		rsp, err := getClient().Get(checksumURL.String())
+		if err != nil {
+			if !strict {
+				log.Debugf("Error fetching %s: %s", checksumURL.String(), err)
+				return "", nil
+			}
+			return "", err
+		}
+
+		if rsp.StatusCode == http.StatusNotFound || (rsp.StatusCode != http.StatusOK && !strict) {
+			log.Debugf("Error fetching %s: %s", checksumURL.String(), rsp.Status)
+			rsp.Body.Close()
+			return "", nil
+		}
+		if rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			return "", fmt.Errorf("Error fetching %s: %s", checksumURL.String(), rsp.Status)
+		}
+
+		src = rsp.Body
+	}
+	defer src.Close()
+
+	return parseChecksumFile(src, name)
+}
+
+// recordDigest writes the digest of a cached image next to it.
+func recordDigest(file, digest string) error {
+	return ioutil.WriteFile(file+digestSuffix, []byte(digest+"\n"), 0644)
+}
+
+// recordedDigest returns the digest of a cached image, or an empty digest
+// for the images cached before digests were recorded.
+func recordedDigest(file string) string {
+	content, err := ioutil.ReadFile(file + digestSuffix)
+	if err != nil {
+		return ""
+	}
+
+	digest := strings.TrimSpace(string(content))
+	if !sha256Pattern.MatchString(digest) {
+		log.Warnf("Ignoring the invalid digest recorded for %s", file)
+		return ""
+	}
+
+	return digest
+}
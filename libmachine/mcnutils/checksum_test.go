@@ -0,0 +1,203 @@
+package mcnutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// newReleaseServer serves an ISO and, unless empty, its checksum file.
+func newReleaseServer(iso, checksums string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v0.19/boot2podman.iso":
+			w.Write([]byte(iso))
+		case "/v0.19/sha256sum.txt":
+			if checksums == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(checksums))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestParseChecksum(t *testing.T) {
+	digest := sha256Hex("iso")
+
+	parsed, err := ParseChecksum("sha256:" + digest)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, parsed)
+
+	parsed, err = ParseChecksum("sha256:" + strings.ToUpper(digest))
+	assert.NoError(t, err)
+	assert.Equal(t, digest, parsed)
+
+	for _, invalid := range []string{digest, "md5:" + digest, "sha256:abc", "sha256:"} {
+		_, err := ParseChecksum(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	checksums := fmt.Sprintf("%s  boot2podman-fedora.iso\n%s *boot2podman.iso\n", sha256Hex("fedora"), sha256Hex("iso"))
+
+	digest, err := parseChecksumFile(strings.NewReader(checksums), "boot2podman.iso")
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex("iso"), digest)
+
+	digest, err = parseChecksumFile(strings.NewReader(checksums), "other.iso")
+	assert.NoError(t, err)
+	assert.Equal(t, "", digest)
+
+	_, err = parseChecksumFile(strings.NewReader("nothex  boot2podman.iso\n"), "boot2podman.iso")
+	assert.Error(t, err)
+}
+
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	testCases := []struct {
+		description string
+		checksums   string
+		expectErr   bool
+	}{
+		{"matching checksum", sha256Hex("iso") + "  boot2podman.iso\n", false},
+		{"no checksum file", "", false},
+		{"truncated download", sha256Hex("iso-with-more-data") + "  boot2podman.iso\n", true},
+	}
+
+	for _, tc := range testCases {
+		ts := newReleaseServer("iso", tc.checksums)
+
+		tmpDir, err := ioutil.TempDir("", "machine-test-")
+		assert.NoError(t, err)
+
+		b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+		digest, err := b.download(tmpDir, "boot2podman.iso", ts.URL+"/v0.19/boot2podman.iso")
+
+		_, statErr := os.Stat(filepath.Join(tmpDir, "boot2podman.iso"))
+		if tc.expectErr {
+			assert.Error(t, err, tc.description)
+			assert.True(t, os.IsNotExist(statErr), tc.description)
+		} else {
+			assert.NoError(t, err, tc.description)
+			assert.Equal(t, sha256Hex("iso"), digest, tc.description)
+			assert.NoError(t, statErr, tc.description)
+		}
+
+		ts.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestDownloadVerifiesFileChecksum(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	dstDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	ioutil.WriteFile(filepath.Join(srcDir, "boot2podman.iso"), []byte("tampered"), 0644)
+	ioutil.WriteFile(filepath.Join(srcDir, checksumFilename), []byte(sha256Hex("iso")+"  boot2podman.iso\n"), 0644)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(dstDir, "boot2podman.iso", "file://"+filepath.ToSlash(filepath.Join(srcDir, "boot2podman.iso")))
+
+	assert.Error(t, err)
+}
+
+func TestDownloadISORecordsDigestInCache(t *testing.T) {
+	ts := newReleaseServer("iso", sha256Hex("iso")+"  boot2podman.iso\n")
+	defer ts.Close()
+
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+	os.MkdirAll(b.imgCachePath, 0700)
+
+	assert.NoError(t, b.DownloadISOFromURL(ts.URL+"/v0.19/boot2podman.iso"))
+	assert.Equal(t, sha256Hex("iso"), recordedDigest(filepath.Join(b.imgCachePath, "boot2podman.iso")))
+
+	images, err := b.ListCache()
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, sha256Hex("iso"), images[0].Digest)
+
+	assert.NoError(t, b.RemoveCachedImage("boot2podman.iso"))
+	_, err = os.Stat(filepath.Join(b.imgCachePath, "boot2podman.iso"+digestSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVerifyMachineIso(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+
+	machineDir := filepath.Join(storePath, "machines", "box")
+	os.MkdirAll(machineDir, 0700)
+	ioutil.WriteFile(filepath.Join(machineDir, "boot2podman.iso"), []byte("iso"), 0644)
+
+	assert.NoError(t, b.VerifyMachineIso("box", "sha256:"+sha256Hex("iso")))
+
+	assert.Error(t, b.VerifyMachineIso("box", "sha256:"+sha256Hex("other")))
+	_, err = os.Stat(filepath.Join(machineDir, "boot2podman.iso"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReleaseChecksumForbidden(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	// any server may deny a file it does not have
+	digest, err := releaseChecksum(ts.URL + "/images/disk.img")
+	assert.NoError(t, err)
+	assert.Equal(t, "", digest)
+
+	// but a mirror publishes its checksums
+	defer func(saved string) { ReleaseSource = saved }(ReleaseSource)
+	ReleaseSource = ts.URL
+
+	_, err = releaseChecksum(ts.URL + "/v0.19/boot2podman.iso")
+	assert.Error(t, err)
+}
+
+func TestIsReleaseURL(t *testing.T) {
+	defer func(saved string) { ReleaseSource = saved }(ReleaseSource)
+	ReleaseSource = "https://mirror.internal/boot2podman/"
+
+	assert.True(t, isReleaseURL("https://github.com/boot2podman/boot2podman/releases/download/v0.19/boot2podman.iso"))
+	assert.True(t, isReleaseURL("https://mirror.internal/boot2podman/v0.19/boot2podman.iso"))
+	assert.False(t, isReleaseURL("https://mirror.internal/other/v0.19/boot2podman.iso"))
+	assert.False(t, isReleaseURL("https://download.fedoraproject.org/pub/fedora/linux/releases/39/Cloud/x86_64/images/Fedora.qcow2"))
+}
@@ -0,0 +1,216 @@
+package mcnutils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+var (
+	// downloadAttempts bounds the attempts of a download, each resuming
+	// where the previous one stopped
+	downloadAttempts = 5
+	// downloadBackoff is the wait before the second attempt, doubled after
+	// each failed attempt
+	downloadBackoff = 2 * time.Second
+)
+
+// validatorSuffix is appended to the name of a partial download for the
+// file holding the ETag or Last-Modified date of the file it is a part of.
+const validatorSuffix = ".validator"
+
+// permanentError is a download error that another attempt cannot fix.
+type permanentError struct {
+	error
+}
+
+// claimPartial moves the partial download left by a failed download, if
+// any, to a file of its own, so that concurrent downloads of the same file
+// never write to the same one. It returns the name of that file, which is
+// empty when there was nothing to resume.
+func claimPartial(partial string) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(partial), filepath.Base(partial)+".*")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	f.Close()
+
+	// only one of the concurrent downloads gets to move it
+	if err := os.Rename(partial, tmp); err == nil {
+		if err := os.Rename(partial+validatorSuffix, tmp+validatorSuffix); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Error moving file: %s", err)
+		}
+	}
+
+	return tmp, nil
+}
+
+// keepPartial moves a partial download back to where the next download
+// resumes it.
+func keepPartial(tmp, partial string) {
+	if err := os.Rename(tmp, partial); err != nil {
+		log.Warnf("Error keeping the partial download: %s", err)
+		return
+	}
+	if err := os.Rename(tmp+validatorSuffix, partial+validatorSuffix); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Error keeping the partial download: %s", err)
+	}
+}
+
+// removePartial removes a partial download and its validator.
+func removePartial(tmp string) {
+	for _, name := range []string{tmp, tmp + validatorSuffix} {
+		if err := removeFileIfExists(name); err != nil {
+			log.Warnf("Error removing file: %s", err)
+		}
+	}
+}
+
+// fetchWithRetries downloads dlURL to the file tmp, resuming what it holds
+// with HTTP Range requests. The ETag or Last-Modified date of dlURL is kept
+// next to tmp, so that it is only resumed when dlURL did not change since,
+// and restarted when there is none.
+func fetchWithRetries(tmp, dlURL string) error {
+	if err := checkOnline(dlURL); err != nil {
+		return err
+	}
+
+	backoff := downloadBackoff
+
+	// the validator makes sure all the parts come from the same file
+	validator := ""
+	if saved, err := ioutil.ReadFile(tmp + validatorSuffix); err == nil {
+		validator = strings.TrimSpace(string(saved))
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fetchRange(tmp, dlURL, &validator)
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(*permanentError); ok {
+			removePartial(tmp)
+			return err
+		}
+
+		if attempt >= downloadAttempts {
+			return fmt.Errorf("Error downloading %s after %d attempts: %s", dlURL, attempt, err)
+		}
+
+		log.Warnf("Download of %s interrupted: %s, retrying in %s...", dlURL, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// fetchRange downloads the part of dlURL that tmp lacks and appends it.
+func fetchRange(tmp, dlURL string, validator *string) error {
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return &permanentError{err}
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req, err := http.NewRequest("GET", dlURL, nil)
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	// without a validator, the part may be of an older file
+	if offset > 0 && *validator == "" {
+		log.Infof("Restarting the download of %s from the beginning...", dlURL)
+		if err := f.Truncate(0); err != nil {
+			return &permanentError{err}
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return &permanentError{err}
+		}
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", *validator)
+	}
+
+	rsp, err := getClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusPartialContent:
+		log.Infof("Resuming the download of %s at byte %d...", dlURL, offset)
+	case http.StatusOK:
+		// the server ignores ranges, or the file changed since the
+		// previous attempt
+		if offset > 0 {
+			log.Infof("Restarting the download of %s from the beginning...", dlURL)
+			if err := f.Truncate(0); err != nil {
+				return &permanentError{err}
+			}
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return &permanentError{err}
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is complete when its size is the one of dlURL
+		if rsp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			return nil
+		}
+		if err := f.Truncate(0); err != nil {
+			return &permanentError{err}
+		}
+		return fmt.Errorf("the partial download does not match %s", dlURL)
+	default:
+		err := fmt.Errorf("Error downloading %s: %s", dlURL, rsp.Status)
+		if rsp.StatusCode >= http.StatusInternalServerError || rsp.StatusCode == http.StatusTooManyRequests {
+			return err
+		}
+		return &permanentError{err}
+	}
+
+	// weak validators cannot be used with If-Range
+	*validator = ""
+	if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		*validator = etag
+	} else if lastModified := rsp.Header.Get("Last-Modified"); lastModified != "" {
+		*validator = lastModified
+	}
+
+	if *validator == "" {
+		if err := removeFileIfExists(tmp + validatorSuffix); err != nil {
+			return &permanentError{err}
+		}
+	} else if err := ioutil.WriteFile(tmp+validatorSuffix, []byte(*validator+"\n"), 0644); err != nil {
+		return &permanentError{err}
+	}
+
+	expectedLength := int64(-1)
+	if rsp.ContentLength >= 0 {
+		expectedLength = offset + rsp.ContentLength
+	}
+
+	src := newReaderWithProgress(rsp.Body, os.Stdout, offset, expectedLength)
+	_, err = io.Copy(f, src)
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
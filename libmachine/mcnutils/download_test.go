@@ -0,0 +1,275 @@
+package mcnutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer serves a file, dropping the connection after dropAfter bytes
+// for the first drops requests.
+type flakyServer struct {
+	content   []byte
+	dropAfter int
+	drops     int
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if filepath.Base(r.URL.Path) == checksumFilename {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	drop := s.drops > 0
+	if drop {
+		s.drops--
+	}
+	s.mu.Unlock()
+
+	if drop {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+		w.Header().Set("ETag", `"iso"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.content[:s.dropAfter])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Set("ETag", `"iso"`)
+	http.ServeContent(w, r, "boot2podman.iso", time.Time{}, bytes.NewReader(s.content))
+}
+
+func (s *flakyServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ranges...)
+}
+
+func withFastRetries(attempts int) func() {
+	savedAttempts, savedBackoff := downloadAttempts, downloadBackoff
+	downloadAttempts, downloadBackoff = attempts, time.Millisecond
+	return func() {
+		downloadAttempts, downloadBackoff = savedAttempts, savedBackoff
+	}
+}
+
+func TestDownloadResumesDroppedConnection(t *testing.T) {
+	defer withFastRetries(3)()
+
+	content := bytes.Repeat([]byte("boot2podman"), 10000)
+	server := &flakyServer{content: content, dropAfter: 40000, drops: 1}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.Equal(t, []string{"", "bytes=40000-"}, server.requests())
+
+	_, err = os.Stat(filepath.Join(tmpDir, "boot2podman.iso.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadKeepsPartialFileAfterRetries(t *testing.T) {
+	defer withFastRetries(2)()
+
+	content := bytes.Repeat([]byte("boot2podman"), 10000)
+	server := &flakyServer{content: content, dropAfter: 30000, drops: 2}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.Error(t, err)
+
+	// the second attempt got a whole new response, which replaced the
+	// first part
+	partial, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso.tmp"))
+	assert.NoError(t, err)
+	assert.Equal(t, content[:30000], partial)
+
+	// the next download resumes the partial file
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.Equal(t, []string{"", "bytes=30000-", "bytes=30000-"}, server.requests())
+}
+
+func TestDownloadDoesNotRetryMissingFile(t *testing.T) {
+	defer withFastRetries(3)()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "boot2podman.iso.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadCompletePartialFile(t *testing.T) {
+	defer withFastRetries(1)()
+
+	content := []byte("boot2podman")
+	server := &flakyServer{content: content}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a download interrupted after its last byte
+	ioutil.WriteFile(filepath.Join(tmpDir, "boot2podman.iso.tmp"), content, 0644)
+	ioutil.WriteFile(filepath.Join(tmpDir, "boot2podman.iso.tmp.validator"), []byte(`"iso"`+"\n"), 0644)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadRestartsPartialFileOfChangedFile(t *testing.T) {
+	defer withFastRetries(1)()
+
+	content := []byte("boot2podman v2")
+	server := &flakyServer{content: content}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a part of the previous release
+	ioutil.WriteFile(filepath.Join(tmpDir, "boot2podman.iso.tmp"), []byte("boot2"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpDir, "boot2podman.iso.tmp.validator"), []byte(`"v1"`+"\n"), 0644)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.Equal(t, []string{"bytes=5-"}, server.requests())
+
+	leftovers, _ := filepath.Glob(filepath.Join(tmpDir, "*.tmp*"))
+	assert.Empty(t, leftovers)
+}
+
+func TestDownloadRestartsPartialFileWithoutValidator(t *testing.T) {
+	defer withFastRetries(1)()
+
+	content := []byte("boot2podman v2")
+	server := &flakyServer{content: content}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "boot2podman.iso.tmp"), []byte("stale"), 0644)
+
+	b := &b2pReleaseGetter{isoFilename: defaultISOFilename}
+	_, err = b.download(tmpDir, "boot2podman.iso", ts.URL+"/boot2podman.iso")
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpDir, "boot2podman.iso"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	assert.Equal(t, []string{""}, server.requests())
+}
+
+func TestClaimPartial(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	partial := filepath.Join(tmpDir, "fedora.qcow2.tmp")
+	ioutil.WriteFile(partial, []byte("qc"), 0644)
+	ioutil.WriteFile(partial+validatorSuffix, []byte(`"fedora"`), 0644)
+
+	first, err := claimPartial(partial)
+	assert.NoError(t, err)
+	second, err := claimPartial(partial)
+	assert.NoError(t, err)
+
+	// only the first download resumes the partial file
+	assert.NotEqual(t, first, second)
+	data, _ := ioutil.ReadFile(first)
+	assert.Equal(t, []byte("qc"), data)
+	validator, _ := ioutil.ReadFile(first + validatorSuffix)
+	assert.Equal(t, []byte(`"fedora"`), validator)
+	data, _ = ioutil.ReadFile(second)
+	assert.Empty(t, data)
+
+	keepPartial(first, partial)
+	data, _ = ioutil.ReadFile(partial)
+	assert.Equal(t, []byte("qc"), data)
+	_, err = os.Stat(partial + validatorSuffix)
+	assert.NoError(t, err)
+}
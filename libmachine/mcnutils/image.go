@@ -0,0 +1,84 @@
+package mcnutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+// BaseImagePath returns the path in the image cache where the disk image
+// at imageURL is stored. The name of the image is prefixed with a digest of
+// imageURL, since different images often share a name, such as disk.img.
+func (b *B2pUtils) BaseImagePath(imageURL string) (string, error) {
+	name, err := baseImageName(imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(imageURL))
+	return filepath.Join(b.imgCachePath, hex.EncodeToString(digest[:])[:12]+"-"+name), nil
+}
+
+// legacyBaseImagePath is where the disk image at imageURL was stored before
+// the name was prefixed, which the machines created then are backed by.
+func (b *B2pUtils) legacyBaseImagePath(imageURL string) (string, error) {
+	name, err := baseImageName(imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(b.imgCachePath, name), nil
+}
+
+func baseImageName(imageURL string) (string, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(filepath.ToSlash(u.Path))
+	if name == "." || name == "/" {
+		return "", fmt.Errorf("Unable to determine the image file name from %q", imageURL)
+	}
+
+	return name, nil
+}
+
+// CacheBaseImage makes sure the disk image at imageURL (a qcow2 or raw cloud
+// image, given as an URL or a local path) is in the image cache, downloading
+// it if needed, and returns the path of the cached copy.
+//
+// Unlike the default ISO, a base image is never replaced once it has been
+// cached, since machines use it as the backing file of their own disk.
+func (b *B2pUtils) CacheBaseImage(imageURL string) (string, error) {
+	imagePath, err := b.BaseImagePath(imageURL)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(imagePath); err == nil {
+		log.Infof("Using cached base image %s", imagePath)
+		return imagePath, nil
+	}
+
+	// recreate the cache dir if it has been manually deleted
+	if _, err := os.Stat(b.imgCachePath); os.IsNotExist(err) {
+		log.Infof("Image cache directory does not exist, creating it at %s...", b.imgCachePath)
+		if err := os.MkdirAll(b.imgCachePath, 0700); err != nil {
+			return "", err
+		}
+	}
+
+	log.Infof("Downloading %s from %s...", imagePath, imageURL)
+	if err := b.downloadFile(b.imgCachePath, filepath.Base(imagePath), imageURL); err != nil {
+		return "", err
+	}
+
+	return imagePath, nil
+}
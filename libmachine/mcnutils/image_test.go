@@ -0,0 +1,58 @@
+package mcnutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBaseImagePath(t *testing.T) {
+	b := NewB2pUtils("/tmp/store")
+
+	imagePath, err := b.BaseImagePath("https://example.com/images/Fedora-Cloud-Base-33.qcow2?mirror=1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/tmp/store", "cache", "3c5afe498c1b-Fedora-Cloud-Base-33.qcow2"), imagePath)
+
+	// images of the same name are told apart
+	fedora38, _ := b.BaseImagePath("https://example.com/38/Fedora.qcow2")
+	fedora39, _ := b.BaseImagePath("https://example.com/39/Fedora.qcow2")
+	assert.Equal(t, filepath.Join("/tmp/store", "cache", "9f067b8415d7-Fedora.qcow2"), fedora38)
+	assert.Equal(t, filepath.Join("/tmp/store", "cache", "bdcf5c33ddf4-Fedora.qcow2"), fedora39)
+
+	_, err = b.BaseImagePath("https://example.com/")
+
+	assert.Error(t, err)
+}
+
+func TestCacheBaseImage(t *testing.T) {
+	testData := "qcow2-data"
+	ts := newTestServer(testData)
+	defer ts.Close()
+
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(storePath)
+
+	b := NewB2pUtils(storePath)
+	imagePath, err := b.CacheBaseImage(ts.URL + "/cloud.qcow2")
+
+	assert.NoError(t, err)
+	expectedPath, _ := b.BaseImagePath(ts.URL + "/cloud.qcow2")
+	assert.Equal(t, expectedPath, imagePath)
+
+	data, err := ioutil.ReadFile(imagePath)
+
+	assert.NoError(t, err)
+	assert.Equal(t, testData, string(data))
+
+	// a cached image is used as is, without downloading it again
+	ts.Close()
+	cachedPath, err := b.CacheBaseImage(ts.URL + "/cloud.qcow2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, imagePath, cachedPath)
+}
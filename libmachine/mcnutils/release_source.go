@@ -0,0 +1,291 @@
+package mcnutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/version"
+)
+
+// releaseIndexFilename is the file a mirror lists its releases in, at its
+// root
+const releaseIndexFilename = "index.json"
+
+var (
+	// ReleaseSource is where the releases of the default ISO are found,
+	// see ParseReleaseSource. The driver plugins, which download the ISO
+	// in their own process, get it from the environment.
+	ReleaseSource = os.Getenv("MACHINE_RELEASE_SOURCE")
+
+	// Offline forbids downloads from the network: only the image cache and
+	// the mirrors in local directories are used.
+	Offline, _ = strconv.ParseBool(os.Getenv("MACHINE_OFFLINE"))
+)
+
+// releaseSource finds the releases of the ISO.
+type releaseSource interface {
+	// latestTag returns the tag of the latest release.
+	latestTag() (string, error)
+	// isoURL returns the download URL of the ISO of a release.
+	isoURL(tag, filename string) (string, error)
+	// String names the source in messages.
+	String() string
+}
+
+// ParseReleaseSource checks a release source, which is one of:
+//   - "github" (or empty) for the releases of boot2podman on github.com
+//   - the URL of a github (enterprise) releases API, such as
+//     https://api.github.com/repos/ORG/REPO/releases
+//   - the URL of a mirror served over HTTP, or the path or file:// URL of a
+//     mirror in a local directory
+//
+// A mirror has an index.json at its root, naming the latest release and
+// optionally listing all of them, and the ISO of each release in a directory
+// named after its tag, like the downloads of github releases:
+//
+//	{"latest": "v0.19", "releases": ["v0.18", "v0.19"]}
+//	v0.19/boot2podman.iso
+//	v0.19/sha256sum.txt
+func ParseReleaseSource(value string) error {
+	_, err := newReleaseSource(value)
+	return err
+}
+
+func newReleaseSource(value string) (releaseSource, error) {
+	if value == "" || value == "github" {
+		return &githubSource{apiURL: defaultURL}, nil
+	}
+
+	if _, _, _, _, ok := parseGithubReleasesURL(value); ok {
+		return &githubSource{apiURL: value}, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid release source %q: %s", value, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &mirrorSource{baseURL: strings.TrimSuffix(value, "/")}, nil
+	case "file":
+		return &mirrorSource{baseURL: "file://" + strings.TrimSuffix(filepath.ToSlash(u.Path), "/")}, nil
+	case "":
+		if !filepath.IsAbs(value) {
+			return nil, fmt.Errorf("Invalid release source %q, expected github, a URL or an absolute path", value)
+		}
+		return &mirrorSource{baseURL: "file://" + strings.TrimSuffix(filepath.ToSlash(value), "/")}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid release source %q, expected github, a URL or an absolute path", value)
+}
+
+// githubDownloadPattern matches the downloads of github (enterprise)
+// releases.
+var githubDownloadPattern = regexp.MustCompile("^https?://[^/]+/[^/]+/[^/]+/releases/download/")
+
+// isReleaseURL tells whether dlURL is the download of a github release or of
+// the mirror set as the release source, which publish a checksum file.
+func isReleaseURL(dlURL string) bool {
+	if githubDownloadPattern.MatchString(dlURL) {
+		return true
+	}
+
+	source, err := newReleaseSource(ReleaseSource)
+	if err != nil {
+		return false
+	}
+	if mirror, ok := source.(*mirrorSource); ok {
+		return strings.HasPrefix(dlURL, mirror.baseURL+"/")
+	}
+
+	return false
+}
+
+// checkOnline fails the downloads from the network in offline mode, before
+// they wait for a connection.
+func checkOnline(dlURL string) error {
+	if !Offline {
+		return nil
+	}
+
+	u, err := url.Parse(dlURL)
+	if err == nil && (u.Scheme == "file" || u.Scheme == "") {
+		return nil
+	}
+
+	return fmt.Errorf("Cannot download %s in offline mode, only the image cache and local mirrors can be used", dlURL)
+}
+
+// githubSource finds the releases with the github releases API.
+type githubSource struct {
+	apiURL string
+}
+
+func (s *githubSource) String() string {
+	if _, host, org, repo, ok := parseGithubReleasesURL(s.apiURL); ok {
+		return fmt.Sprintf("%s/%s/%s", host, org, repo)
+	}
+	return s.apiURL
+}
+
+func (s *githubSource) latestTag() (string, error) {
+	apiURL := s.apiURL
+
+	if !version.RC() {
+		// Just go straight to the convenience URL for "/latest" if we
+		// are a non-release candidate version.  "/latest" won't return
+		// non-RCs, so that's what we use for stable releases of
+		// Machine.
+		apiURL = apiURL + "/latest"
+	}
+
+	if err := checkOnline(apiURL); err != nil {
+		return "", err
+	}
+
+	client := getClient()
+	req, err := getRequest(apiURL)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	// If we call the API endpoint
+	// "/repos/boot2podman/boot2podman/releases" without specifying
+	// "/latest", we will receive a list of releases instead of a single
+	// one, and we should decode accordingly.
+	if version.RC() {
+		var tags []struct {
+			TagName string `json:"tag_name"`
+		}
+		if err := json.NewDecoder(rsp.Body).Decode(&tags); err != nil {
+			return "", err
+		}
+		if len(tags) == 0 || tags[0].TagName == "" {
+			return "", errGitHubAPIResponse
+		}
+		return tags[0].TagName, nil
+	}
+
+	// Otherwise, we get back just one release, which we can decode to get
+	// the tag.
+	var t struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.TagName == "" {
+		return "", errGitHubAPIResponse
+	}
+	return t.TagName, nil
+}
+
+func (s *githubSource) isoURL(tag, filename string) (string, error) {
+	scheme, host, org, repo, ok := parseGithubReleasesURL(s.apiURL)
+	if !ok {
+		return "", fmt.Errorf("Cannot pick release %s of %s, which is not a Github releases URL", tag, s.apiURL)
+	}
+
+	return fmt.Sprintf("%s://%s/%s/%s/releases/download/%s/%s", scheme, host, org, repo, tag, filename), nil
+}
+
+// mirrorSource finds the releases in the index of a mirror, over HTTP or in
+// a local directory.
+type mirrorSource struct {
+	baseURL string
+}
+
+// releaseIndex is the index.json of a mirror.
+type releaseIndex struct {
+	Latest   string   `json:"latest"`
+	Releases []string `json:"releases"`
+}
+
+func (s *mirrorSource) String() string {
+	return s.baseURL
+}
+
+func (s *mirrorSource) index() (*releaseIndex, error) {
+	indexURL := s.baseURL + "/" + releaseIndexFilename
+
+	var src io.ReadCloser
+	if strings.HasPrefix(indexURL, "file://") {
+		f, err := os.Open(filepath.FromSlash(strings.TrimPrefix(indexURL, "file://")))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the release index of %s: %s", s.baseURL, err)
+		}
+
+		src = f
+	} else {
+		if err := checkOnline(indexURL); err != nil {
+			return nil, err
+		}
+
+		rsp, err := getClient().Get(indexURL)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching the release index of %s: %s", s.baseURL, err)
+		}
+		if rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			return nil, fmt.Errorf("Error fetching the release index of %s: %s", s.baseURL, rsp.Status)
+		}
+
+		src = rsp.Body
+	}
+	defer src.Close()
+
+	index := &releaseIndex{}
+	if err := json.NewDecoder(src).Decode(index); err != nil {
+		return nil, fmt.Errorf("Error reading the release index of %s: %s", s.baseURL, err)
+	}
+
+	return index, nil
+}
+
+func (s *mirrorSource) latestTag() (string, error) {
+	index, err := s.index()
+	if err != nil {
+		return "", err
+	}
+
+	if index.Latest == "" {
+		return "", fmt.Errorf("The release index of %s does not name the latest release", s.baseURL)
+	}
+
+	return index.Latest, nil
+}
+
+func (s *mirrorSource) isoURL(tag, filename string) (string, error) {
+	index, err := s.index()
+	if err != nil {
+		return "", err
+	}
+
+	// without a list, any release may be there
+	if len(index.Releases) > 0 {
+		found := tag == index.Latest
+		for _, release := range index.Releases {
+			found = found || release == tag
+		}
+		if !found {
+			return "", fmt.Errorf("No release %s in the mirror %s, it has %s", tag, s.baseURL, strings.Join(index.Releases, ", "))
+		}
+	}
+
+	return s.baseURL + "/" + path.Join(tag, filename), nil
+}
@@ -0,0 +1,134 @@
+package mcnutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReleaseSource(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected releaseSource
+	}{
+		{"", &githubSource{apiURL: defaultURL}},
+		{"github", &githubSource{apiURL: defaultURL}},
+		{"https://github.example.com/api/v3/repos/org/repo/releases", &githubSource{apiURL: "https://github.example.com/api/v3/repos/org/repo/releases"}},
+		{"http://mirror.internal/boot2podman/", &mirrorSource{baseURL: "http://mirror.internal/boot2podman"}},
+		{"file:///srv/boot2podman", &mirrorSource{baseURL: "file:///srv/boot2podman"}},
+	}
+
+	for _, tc := range testCases {
+		source, err := newReleaseSource(tc.value)
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.expected, source, tc.value)
+	}
+
+	assert.Error(t, ParseReleaseSource("relative/mirror"))
+	assert.Error(t, ParseReleaseSource("ftp://mirror.internal/boot2podman"))
+}
+
+func TestMirrorSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/boot2podman/index.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"latest": "v0.19", "releases": ["v0.18", "v0.19"]}`))
+	}))
+	defer ts.Close()
+
+	source, err := newReleaseSource(ts.URL + "/boot2podman/")
+	assert.NoError(t, err)
+
+	tag, err := source.latestTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v0.19", tag)
+
+	isoURL, err := source.isoURL("v0.18", "boot2podman.iso")
+	assert.NoError(t, err)
+	assert.Equal(t, ts.URL+"/boot2podman/v0.18/boot2podman.iso", isoURL)
+
+	_, err = source.isoURL("v0.17", "boot2podman.iso")
+	assert.Error(t, err)
+
+	missing := &mirrorSource{baseURL: ts.URL + "/other"}
+	_, err = missing.latestTag()
+	assert.Error(t, err)
+}
+
+// newLocalMirror creates a mirror in a local directory with the given latest
+// release.
+func newLocalMirror(t *testing.T, latest string) string {
+	mirror, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(mirror, latest), 0700)
+	ioutil.WriteFile(filepath.Join(mirror, releaseIndexFilename), []byte(`{"latest": "`+latest+`"}`), 0644)
+	ioutil.WriteFile(filepath.Join(mirror, latest, defaultISOFilename), dummyISOData("  ", latest), 0644)
+
+	return mirror
+}
+
+func TestUpdateISOCacheFromLocalMirrorOffline(t *testing.T) {
+	mirror := newLocalMirror(t, "v0.19")
+	defer os.RemoveAll(mirror)
+
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	defer func(source string, offline bool) {
+		ReleaseSource, Offline = source, offline
+	}(ReleaseSource, Offline)
+	ReleaseSource, Offline = mirror, true
+
+	b := NewB2pUtils(storePath)
+	assert.NoError(t, b.UpdateISOCache(""))
+
+	data, err := ioutil.ReadFile(filepath.Join(storePath, "cache", defaultISOFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, dummyISOData("  ", "v0.19"), data)
+}
+
+func TestOfflineFailsFast(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	defer func(source string, offline bool) {
+		ReleaseSource, Offline = source, offline
+	}(ReleaseSource, Offline)
+	ReleaseSource, Offline = "", true
+
+	b := NewB2pUtils(storePath)
+
+	err = b.UpdateISOCache("")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "offline mode")
+
+	_, err = b.CacheBaseImage("https://example.com/fedora.qcow2")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "offline mode")
+
+	// the cached images are still used
+	os.MkdirAll(filepath.Join(storePath, "cache"), 0700)
+	imagePath, _ := b.BaseImagePath("https://example.com/fedora.qcow2")
+	ioutil.WriteFile(imagePath, []byte("qcow"), 0644)
+	ioutil.WriteFile(filepath.Join(storePath, "cache", defaultISOFilename), dummyISOData("  ", "v0.18"), 0644)
+
+	_, err = b.CacheBaseImage("https://example.com/fedora.qcow2")
+	assert.NoError(t, err)
+	assert.NoError(t, b.UpdateISOCache(""))
+}
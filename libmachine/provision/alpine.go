@@ -0,0 +1,150 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/serviceaction"
+)
+
+func init() {
+	Register("Alpine", &RegisteredProvisioner{
+		New: NewAlpineProvisioner,
+	})
+}
+
+func NewAlpineProvisioner(d drivers.Driver) Provisioner {
+	p := NewOpenRCProvisioner("alpine", d)
+	p.Packages = []string{"podman"}
+	return &AlpineProvisioner{
+		p,
+	}
+}
+
+type AlpineProvisioner struct {
+	OpenRCProvisioner
+}
+
+func (provisioner *AlpineProvisioner) String() string {
+	return "alpine"
+}
+
+func (provisioner *AlpineProvisioner) SetHostname(hostname string) error {
+	if _, err := provisioner.SSHCommand(fmt.Sprintf(
+		"echo %q | sudo tee /etc/hostname && sudo hostname -F /etc/hostname",
+		hostname,
+	)); err != nil {
+		return err
+	}
+
+	if _, err := provisioner.SSHCommand(fmt.Sprintf(
+		"if grep -q '^127.0.1.1' /etc/hosts; then sudo sed -i 's/^127.0.1.1.*/127.0.1.1 %s/g' /etc/hosts; else echo '127.0.1.1 %s' | sudo tee -a /etc/hosts; fi",
+		hostname,
+		hostname,
+	)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *AlpineProvisioner) Package(name string, action pkgaction.PackageAction) error {
+	var packageAction string
+
+	switch action {
+	case pkgaction.Install:
+		packageAction = "add"
+	case pkgaction.Remove:
+		packageAction = "del"
+	case pkgaction.Purge:
+		packageAction = "del --purge"
+	case pkgaction.Upgrade:
+		packageAction = "add --upgrade"
+	}
+
+	command := fmt.Sprintf("sudo %sapk --update-cache %s %s", proxyPrefix(provisioner.EngineOptions), packageAction, name)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *AlpineProvisioner) PackageVersion(name string) (string, error) {
+	// e.g. "podman-4.4.1-r1 x86_64 {podman} (Apache-2.0) [installed]"
+	installed, err := provisioner.SSHCommand(fmt.Sprintf("apk list --installed %s", name))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(installed)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], name+"-") {
+		return "", fmt.Errorf("Package %s is not installed", name)
+	}
+
+	return strings.TrimPrefix(fields[0], name+"-"), nil
+}
+
+func (provisioner *AlpineProvisioner) InstallPackageVersion(name, version string) error {
+	command := fmt.Sprintf("sudo %sapk --update-cache add '%s=%s'", proxyPrefix(provisioner.EngineOptions), name, version)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *AlpineProvisioner) Provision(authOptions auth.Options, engineOptions engine.Options) error {
+	var (
+		err error
+	)
+
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+
+	if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
+		return err
+	}
+
+	// podman lives in the community repository, which is not always
+	// enabled in the default /etc/apk/repositories
+	if _, err := provisioner.SSHCommand(`sudo sed -i -e 's|^#\(.*/community\)$|\1|' /etc/apk/repositories`); err != nil {
+		return err
+	}
+
+	for _, pkg := range provisioner.Packages {
+		log.Debugf("installing base package: name=%s", pkg)
+		if err := provisioner.Package(pkg, pkgaction.Install); err != nil {
+			return err
+		}
+	}
+
+	// podman needs the cgroup hierarchy mounted, which OpenRC only does
+	// through the cgroups service
+	if err := provisioner.Service("cgroups", serviceaction.Enable); err != nil {
+		return err
+	}
+
+	if err := provisioner.Service("cgroups", serviceaction.Start); err != nil {
+		return err
+	}
+
+	if err := configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
+	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
+
+	if err := ConfigureAuth(provisioner); err != nil {
+		return err
+	}
+
+	return err
+}
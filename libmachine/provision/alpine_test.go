@@ -0,0 +1,56 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/thelonelyghost/p2box/libmachine/provision/serviceaction"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlpineCompatibleWithHost(t *testing.T) {
+	p := NewAlpineProvisioner(&fakedriver.Driver{})
+
+	p.SetOsReleaseInfo(&OsRelease{ID: "alpine"})
+	assert.True(t, p.CompatibleWithHost())
+
+	p.SetOsReleaseInfo(&OsRelease{ID: "boot2podman"})
+	assert.False(t, p.CompatibleWithHost())
+}
+
+func TestAlpinePackageAndService(t *testing.T) {
+	p := NewAlpineProvisioner(&fakedriver.Driver{}).(*AlpineProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo apk --update-cache add podman":       "",
+			"sudo apk --update-cache del --purge htop": "",
+			"sudo rc-update add cgroups default":       "",
+			"sudo rc-service cgroups restart":          "",
+		},
+	}
+
+	assert.NoError(t, p.Package("podman", pkgaction.Install))
+	assert.NoError(t, p.Package("htop", pkgaction.Purge))
+	assert.NoError(t, p.Service("cgroups", serviceaction.Enable))
+	assert.NoError(t, p.Service("cgroups", serviceaction.Restart))
+	assert.NoError(t, p.Service("cgroups", serviceaction.DaemonReload))
+}
+
+func TestAlpinePackageVersion(t *testing.T) {
+	p := NewAlpineProvisioner(&fakedriver.Driver{}).(*AlpineProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"apk list --installed podman": "podman-4.4.1-r1 x86_64 {podman} (Apache-2.0) [installed]\n",
+			"apk list --installed htop":   "",
+		},
+	}
+
+	version, err := p.PackageVersion("podman")
+	assert.NoError(t, err)
+	assert.Equal(t, "4.4.1-r1", version)
+
+	_, err = p.PackageVersion("htop")
+	assert.Error(t, err)
+}
@@ -48,7 +48,10 @@ func (provisioner *Boot2PodmanProvisioner) Service(name string, action serviceac
 	return err
 }
 
-func (provisioner *Boot2PodmanProvisioner) upgradeIso() error {
+// replaceIso lets fetch get the new ISO, if needed, then stops the machine,
+// lets replace swap its ISO, and starts it back up, even when the swap
+// failed.
+func (provisioner *Boot2PodmanProvisioner) replaceIso(fetch, replace func(b2putils *mcnutils.B2pUtils, isoURL, machineName string) error) error {
 	// TODO: Ideally, we should not read from mcndirs directory at all.
 	// The driver should be able to communicate how and where to place the
 	// relevant files.
@@ -64,7 +67,16 @@ func (provisioner *Boot2PodmanProvisioner) upgradeIso() error {
 	}
 	json.Unmarshal(jsonDriver, &d)
 
-	log.Info("Stopping machine to do the upgrade...")
+	machineName := provisioner.GetDriver().GetMachineName()
+
+	// the machine keeps running until the ISO is there
+	if fetch != nil {
+		if err := fetch(b2putils, d.Boot2PodmanURL, machineName); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Stopping machine to replace its ISO...")
 
 	if err := provisioner.Driver.Stop(); err != nil {
 		return err
@@ -74,14 +86,11 @@ func (provisioner *Boot2PodmanProvisioner) upgradeIso() error {
 		return err
 	}
 
-	machineName := provisioner.GetDriver().GetMachineName()
-
-	log.Infof("Upgrading machine %q...", machineName)
+	log.Infof("Replacing the ISO of machine %q...", machineName)
 
-	// Either download the latest version of the b2p url that was explicitly
-	// specified when creating the VM or copy the (updated) default ISO
-	if err := b2putils.CopyIsoToMachineDir(d.Boot2PodmanURL, machineName); err != nil {
-		return err
+	replaceErr := replace(b2putils, d.Boot2PodmanURL, machineName)
+	if replaceErr != nil {
+		log.Warnf("Error replacing the ISO of machine %q: %s", machineName, replaceErr)
 	}
 
 	log.Infof("Starting machine back up...")
@@ -90,18 +99,56 @@ func (provisioner *Boot2PodmanProvisioner) upgradeIso() error {
 		return err
 	}
 
-	return mcnutils.WaitFor(drivers.MachineInState(provisioner.Driver, state.Running))
+	if err := mcnutils.WaitFor(drivers.MachineInState(provisioner.Driver, state.Running)); err != nil {
+		return err
+	}
+
+	return replaceErr
+}
+
+// upgradeIso replaces the ISO with the release of the given tag, or the
+// latest one when empty.
+func (provisioner *Boot2PodmanProvisioner) upgradeIso(tag string) error {
+	return provisioner.replaceIso(func(b2putils *mcnutils.B2pUtils, isoURL, machineName string) error {
+		// Either download the latest version of the b2p url that was explicitly
+		// specified when creating the VM or copy the (updated) default ISO
+		return b2putils.FetchMachineIso(isoURL, tag, machineName)
+	}, func(b2putils *mcnutils.B2pUtils, isoURL, machineName string) error {
+		return b2putils.InstallMachineIso(machineName)
+	})
 }
 
 func (provisioner *Boot2PodmanProvisioner) Package(name string, action pkgaction.PackageAction) error {
 	if name == "podman" && action == pkgaction.Upgrade {
-		if err := provisioner.upgradeIso(); err != nil {
+		if err := provisioner.upgradeIso(""); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// PackageVersion returns the release of the ISO, which podman is part of.
+func (provisioner *Boot2PodmanProvisioner) PackageVersion(name string) (string, error) {
+	b2putils := mcnutils.NewB2pUtils(mcndirs.GetBaseDir())
+	return b2putils.MachineIsoVersion(provisioner.GetDriver().GetMachineName())
+}
+
+// InstallPackageVersion boots the ISO of the release with the given tag.
+func (provisioner *Boot2PodmanProvisioner) InstallPackageVersion(name, version string) error {
+	if name != "podman" {
+		return fmt.Errorf("Cannot install %s, boot2podman only upgrades podman with its ISO", name)
+	}
+
+	return provisioner.upgradeIso(version)
+}
+
+// RollbackPackage boots the ISO the machine had before its last upgrade.
+func (provisioner *Boot2PodmanProvisioner) RollbackPackage(name string) error {
+	return provisioner.replaceIso(nil, func(b2putils *mcnutils.B2pUtils, isoURL, machineName string) error {
+		return b2putils.RollbackMachineIso(machineName)
+	})
+}
+
 func (provisioner *Boot2PodmanProvisioner) Hostname() (string, error) {
 	return provisioner.SSHCommand("hostname")
 }
@@ -137,8 +184,6 @@ func (provisioner *Boot2PodmanProvisioner) GenerateEngineOptions() (*EngineOptio
 	engineConfigTmpl := `
 EXTRA_ARGS='
 {{ range .EngineOptions.Labels }}--label {{.}}
-{{ end }}{{ range .EngineOptions.InsecureRegistry }}--insecure-registry {{.}}
-{{ end }}{{ range .EngineOptions.RegistryMirror }}--registry-mirror {{.}}
 {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}}
 {{ end }}
 '
@@ -196,6 +241,10 @@ func (provisioner *Boot2PodmanProvisioner) Provision(authOptions auth.Options, e
 		return err
 	}
 
+	if err = configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
 	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
 
 	if err = ConfigureAuth(provisioner); err != nil {
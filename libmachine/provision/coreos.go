@@ -0,0 +1,185 @@
+package provision
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/serviceaction"
+)
+
+func init() {
+	Register("CoreOS", &RegisteredProvisioner{
+		New: NewCoreOSProvisioner,
+		// a more specific match than the Fedora provisioner
+		Priority: 10,
+	})
+}
+
+func NewCoreOSProvisioner(d drivers.Driver) Provisioner {
+	return &CoreOSProvisioner{
+		NewSystemdProvisioner("fedora", d),
+	}
+}
+
+// CoreOSProvisioner provisions Fedora CoreOS, where packages are layered
+// onto the immutable OS image with rpm-ostree.
+type CoreOSProvisioner struct {
+	SystemdProvisioner
+}
+
+func (provisioner *CoreOSProvisioner) String() string {
+	return "coreos"
+}
+
+func (provisioner *CoreOSProvisioner) CompatibleWithHost() bool {
+	return provisioner.OsReleaseInfo.ID == provisioner.OsReleaseID && provisioner.OsReleaseInfo.VariantID == "coreos"
+}
+
+func (provisioner *CoreOSProvisioner) SetHostname(hostname string) error {
+	if _, err := provisioner.SSHCommand(fmt.Sprintf("sudo hostnamectl set-hostname %s", hostname)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *CoreOSProvisioner) Package(name string, action pkgaction.PackageAction) error {
+	var command string
+
+	switch action {
+	case pkgaction.Install:
+		command = fmt.Sprintf("sudo rpm-ostree install --idempotent --allow-inactive %s", name)
+	case pkgaction.Remove, pkgaction.Purge:
+		command = fmt.Sprintf("sudo rpm-ostree uninstall %s", name)
+	case pkgaction.Upgrade:
+		// podman is part of the OS image, so upgrading it means
+		// upgrading the whole deployment
+		command = "sudo rpm-ostree upgrade"
+	}
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return provisioner.rebootIfStaged()
+}
+
+// rebootIfStaged reboots into the pending deployment, if rpm-ostree staged
+// one, and waits for the machine to come back.
+func (provisioner *CoreOSProvisioner) rebootIfStaged() error {
+	// --pending-exit-77 makes rpm-ostree exit with 77 when a deployment
+	// is waiting for a reboot
+	out, err := provisioner.SSHCommand("rpm-ostree status --pending-exit-77 > /dev/null; [ $? -eq 77 ] && echo pending || true")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(out) != "pending" {
+		return nil
+	}
+
+	bootID, err := provisioner.SSHCommand("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return err
+	}
+
+	log.Info("Rebooting into the new rpm-ostree deployment...")
+
+	// the connection is dropped by the reboot, so the error is expected
+	if _, err := provisioner.SSHCommand("sudo systemctl reboot"); err != nil {
+		log.Debugf("Error rebooting machine (expected): %s", err)
+	}
+
+	rebooted := func() bool {
+		newBootID, err := provisioner.SSHCommand("cat /proc/sys/kernel/random/boot_id")
+		return err == nil && newBootID != bootID
+	}
+
+	return mcnutils.WaitForSpecific(rebooted, 60, 3*time.Second)
+}
+
+// configureRpmOstreeProxy passes the proxy settings to rpm-ostreed, which
+// does the downloads for the rpm-ostree client without its environment.
+// rpmOstreeProxyDropIn returns the drop-in passing the proxy to rpm-ostreed,
+// and false when there is no proxy.
+func (provisioner *CoreOSProvisioner) rpmOstreeProxyDropIn() (podmanConfigFile, bool) {
+	env := proxyEnvironment(provisioner.EngineOptions)
+	if len(env) == 0 {
+		return podmanConfigFile{}, false
+	}
+
+	dropIn := "[Service]\n"
+	for _, v := range env {
+		dropIn += fmt.Sprintf("Environment=%q\n", v)
+	}
+
+	return podmanConfigFile{path.Join(provisioner.systemdUnitDir(), "rpm-ostreed.service.d/proxy.conf"), dropIn}, true
+}
+
+func (provisioner *CoreOSProvisioner) configureRpmOstreeProxy() error {
+	dropIn, ok := provisioner.rpmOstreeProxyDropIn()
+	if !ok {
+		return nil
+	}
+
+	if err := WriteRemoteFile(provisioner, dropIn.Path, dropIn.Content); err != nil {
+		return err
+	}
+
+	if _, err := provisioner.SSHCommand("sudo systemctl daemon-reload && sudo systemctl try-restart rpm-ostreed"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *CoreOSProvisioner) Provision(authOptions auth.Options, engineOptions engine.Options) error {
+	var (
+		err error
+	)
+
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+
+	if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
+		return err
+	}
+
+	if err := provisioner.configureRpmOstreeProxy(); err != nil {
+		return err
+	}
+
+	for _, pkg := range provisioner.Packages {
+		log.Debugf("installing base package: name=%s", pkg)
+		if err := provisioner.Package(pkg, pkgaction.Install); err != nil {
+			return err
+		}
+	}
+
+	if err := provisioner.Service("podman.socket", serviceaction.Enable); err != nil {
+		return err
+	}
+
+	if err := provisioner.Service("podman.socket", serviceaction.Start); err != nil {
+		return err
+	}
+
+	if err := configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
+	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
+
+	if err := ConfigureAuth(provisioner); err != nil {
+		return err
+	}
+
+	return err
+}
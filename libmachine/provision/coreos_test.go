@@ -0,0 +1,41 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoreOSCompatibleWithHost(t *testing.T) {
+	fcos := &OsRelease{ID: "fedora", VariantID: "coreos"}
+	fedora := &OsRelease{ID: "fedora", VariantID: "cloud"}
+
+	coreos := NewCoreOSProvisioner(&fakedriver.Driver{})
+	fedoraProvisioner := NewFedoraProvisioner(&fakedriver.Driver{})
+
+	coreos.SetOsReleaseInfo(fcos)
+	fedoraProvisioner.SetOsReleaseInfo(fcos)
+	assert.True(t, coreos.CompatibleWithHost())
+	// both match, the priority of coreos decides
+	assert.True(t, fedoraProvisioner.CompatibleWithHost())
+
+	coreos.SetOsReleaseInfo(fedora)
+	fedoraProvisioner.SetOsReleaseInfo(fedora)
+	assert.False(t, coreos.CompatibleWithHost())
+	assert.True(t, fedoraProvisioner.CompatibleWithHost())
+}
+
+func TestCoreOSPackageWithoutStagedDeployment(t *testing.T) {
+	p := NewCoreOSProvisioner(&fakedriver.Driver{}).(*CoreOSProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo rpm-ostree install --idempotent --allow-inactive htop":                             "",
+			"rpm-ostree status --pending-exit-77 > /dev/null; [ $? -eq 77 ] && echo pending || true": "\n",
+		},
+	}
+
+	assert.NoError(t, p.Package("htop", pkgaction.Install))
+}
@@ -0,0 +1,96 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+const defaultCopyFileMode = 0644
+
+// ParseCopyFile splits a LOCAL:REMOTE[:mode] file copy, where mode is
+// octal. The local path may contain colons, as in Windows drive letters.
+func ParseCopyFile(spec string) (string, string, os.FileMode, error) {
+	parts := strings.Split(spec, ":")
+	mode := os.FileMode(defaultCopyFileMode)
+
+	if len(parts) > 2 {
+		if m, err := strconv.ParseUint(parts[len(parts)-1], 8, 32); err == nil {
+			mode = os.FileMode(m)
+			parts = parts[:len(parts)-1]
+		}
+	}
+
+	if len(parts) < 2 {
+		return "", "", 0, fmt.Errorf("Invalid file copy %q, expected LOCAL:REMOTE[:mode]", spec)
+	}
+
+	local := strings.Join(parts[:len(parts)-1], ":")
+	remote := parts[len(parts)-1]
+
+	if local == "" || !strings.HasPrefix(remote, "/") {
+		return "", "", 0, fmt.Errorf("Invalid file copy %q, expected LOCAL:REMOTE[:mode] with an absolute REMOTE path", spec)
+	}
+
+	return local, remote, mode, nil
+}
+
+// CopyFiles copies local files to the machine, given as LOCAL:REMOTE[:mode].
+// The files are owned by root.
+func CopyFiles(p SSHCommander, specs []string) error {
+	for _, spec := range specs {
+		local, remote, mode, err := ParseCopyFile(spec)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(local)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Copying %s to %s...", local, remote)
+
+		if err := WriteRemoteFile(p, remote, string(content)); err != nil {
+			return fmt.Errorf("Error copying %s: %s", local, err)
+		}
+
+		if _, err := p.SSHCommand(fmt.Sprintf("sudo chmod %o %s", mode, shellQuote(remote))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunScripts runs local shell scripts on the machine as root, in order.
+func RunScripts(p SSHCommander, scripts []string) error {
+	for _, script := range scripts {
+		content, err := ioutil.ReadFile(script)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Running provisioning script %s...", script)
+
+		// the script is copied first, it may be too large for a command
+		remote := path.Join("/tmp", "provision-"+filepath.Base(script))
+		if err := WriteRemoteFile(p, remote, string(content)); err != nil {
+			return fmt.Errorf("Error copying provisioning script %s: %s", script, err)
+		}
+
+		output, err := p.SSHCommand(fmt.Sprintf("sudo sh %s; status=$?; sudo rm -f %s; exit $status", shellQuote(remote), shellQuote(remote)))
+		log.Debugf("provisioning script output: %s", output)
+		if err != nil {
+			return fmt.Errorf("Error running provisioning script %s: %s", script, err)
+		}
+	}
+
+	return nil
+}
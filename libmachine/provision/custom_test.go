@@ -0,0 +1,70 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCopyFile(t *testing.T) {
+	cases := []struct {
+		spec   string
+		local  string
+		remote string
+		mode   os.FileMode
+	}{
+		{"ca.crt:/etc/pki/ca.crt", "ca.crt", "/etc/pki/ca.crt", 0644},
+		{"run.sh:/usr/local/bin/run.sh:755", "run.sh", "/usr/local/bin/run.sh", 0755},
+		{`C:\certs\ca.crt:/etc/pki/ca.crt:0600`, `C:\certs\ca.crt`, "/etc/pki/ca.crt", 0600},
+		{`C:\certs\ca.crt:/etc/pki/ca.crt`, `C:\certs\ca.crt`, "/etc/pki/ca.crt", 0644},
+	}
+
+	for _, c := range cases {
+		local, remote, mode, err := ParseCopyFile(c.spec)
+		assert.NoError(t, err, c.spec)
+		assert.Equal(t, c.local, local, c.spec)
+		assert.Equal(t, c.remote, remote, c.spec)
+		assert.Equal(t, c.mode, mode, c.spec)
+	}
+}
+
+func TestParseCopyFileInvalid(t *testing.T) {
+	for _, spec := range []string{"ca.crt", ":/etc/ca.crt", "ca.crt:etc/ca.crt", "ca.crt:644"} {
+		_, _, _, err := ParseCopyFile(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCopyFilesAndRunScripts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "motd")
+	script := filepath.Join(tmpDir, "setup.sh")
+	if err := ioutil.WriteFile(file, []byte("hi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(script, []byte("echo hi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	commander := &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo mkdir -p '/etc' && printf '%s' 'aGkK' | base64 -d | sudo tee '/etc/motd' > /dev/null": "",
+			"sudo chmod 600 '/etc/motd'": "",
+			"sudo mkdir -p '/tmp' && printf '%s' 'ZWNobyBoaQo=' | base64 -d | sudo tee '/tmp/provision-setup.sh' > /dev/null": "",
+			"sudo sh '/tmp/provision-setup.sh'; status=$?; sudo rm -f '/tmp/provision-setup.sh'; exit $status":                "hi\n",
+		},
+	}
+
+	assert.NoError(t, CopyFiles(commander, []string{file + ":/etc/motd:600"}))
+	assert.NoError(t, RunScripts(commander, []string{script}))
+	assert.Error(t, RunScripts(commander, []string{filepath.Join(tmpDir, "missing.sh")}))
+}
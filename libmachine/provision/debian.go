@@ -0,0 +1,207 @@
+package provision
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+)
+
+const (
+	kubicRepositoryURL = "https://download.opensuse.org/repositories/devel:/kubic:/libcontainers:/stable"
+	kubicSourcesList   = "/etc/apt/sources.list.d/devel:kubic:libcontainers:stable.list"
+	// kubicKeyring holds the key of the Kubic repository, which only signs
+	// that repository, apt-key being gone from the newer releases
+	kubicKeyring = "/etc/apt/keyrings/devel_kubic_libcontainers_stable.gpg"
+
+	aptGetArgs = `DEBIAN_FRONTEND=noninteractive apt-get -y -q -o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold"`
+)
+
+func init() {
+	Register("Debian", &RegisteredProvisioner{
+		New: NewDebianProvisioner,
+	})
+}
+
+func NewDebianProvisioner(d drivers.Driver) Provisioner {
+	return &DebianProvisioner{
+		NewSystemdProvisioner("debian", d),
+	}
+}
+
+// DebianProvisioner provisions Debian, Ubuntu and their derivatives.
+type DebianProvisioner struct {
+	SystemdProvisioner
+}
+
+func (provisioner *DebianProvisioner) String() string {
+	return "debian"
+}
+
+func (provisioner *DebianProvisioner) CompatibleWithHost() bool {
+	switch provisioner.OsReleaseInfo.ID {
+	case "debian", "ubuntu":
+		return true
+	}
+
+	for _, id := range strings.Fields(provisioner.OsReleaseInfo.IDLike) {
+		if id == "debian" || id == "ubuntu" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aptGet returns the apt-get command, run through sudo with the proxy
+// settings.
+func (provisioner *DebianProvisioner) aptGet() string {
+	return fmt.Sprintf("sudo %s%s", proxyPrefix(provisioner.EngineOptions), aptGetArgs)
+}
+
+func (provisioner *DebianProvisioner) Package(name string, action pkgaction.PackageAction) error {
+	var packageAction string
+
+	updateMetadata := true
+
+	switch action {
+	case pkgaction.Install:
+		packageAction = "install"
+	case pkgaction.Remove:
+		packageAction = "remove"
+		updateMetadata = false
+	case pkgaction.Purge:
+		packageAction = "purge"
+		updateMetadata = false
+	case pkgaction.Upgrade:
+		packageAction = "install --only-upgrade"
+	}
+
+	if updateMetadata {
+		if _, err := provisioner.SSHCommand(fmt.Sprintf("%s update", provisioner.aptGet())); err != nil {
+			return err
+		}
+	}
+
+	command := fmt.Sprintf("%s %s %s", provisioner.aptGet(), packageAction, name)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *DebianProvisioner) PackageVersion(name string) (string, error) {
+	version, err := provisioner.SSHCommand(fmt.Sprintf("dpkg-query --show --showformat '${Version}' %s", name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(version), nil
+}
+
+func (provisioner *DebianProvisioner) InstallPackageVersion(name, version string) error {
+	if _, err := provisioner.SSHCommand(fmt.Sprintf("%s update", provisioner.aptGet())); err != nil {
+		return err
+	}
+
+	if _, err := provisioner.SSHCommand(fmt.Sprintf("%s install --allow-downgrades %s=%s", provisioner.aptGet(), name, version)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// kubicRepository returns the Kubic repository matching the distribution,
+// for releases which do not ship podman themselves.
+func (provisioner *DebianProvisioner) kubicRepository() string {
+	distro := "Debian"
+	if provisioner.OsReleaseInfo.ID == "ubuntu" {
+		distro = "xUbuntu"
+	} else {
+		for _, id := range strings.Fields(provisioner.OsReleaseInfo.IDLike) {
+			if id == "ubuntu" {
+				distro = "xUbuntu"
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s/%s_%s/", kubicRepositoryURL, distro, provisioner.OsReleaseInfo.VersionID)
+}
+
+func (provisioner *DebianProvisioner) installPodman() error {
+	if _, err := provisioner.SSHCommand("command -v podman"); err == nil {
+		log.Debug("podman is already installed")
+		return nil
+	}
+
+	if _, err := provisioner.SSHCommand(fmt.Sprintf("%s update", provisioner.aptGet())); err != nil {
+		return err
+	}
+
+	candidate, err := provisioner.SSHCommand("apt-cache policy podman | grep Candidate || true")
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(candidate, "Candidate:") || strings.Contains(candidate, "(none)") {
+		repository := provisioner.kubicRepository()
+		log.Infof("podman is not packaged for this release, adding the Kubic repository %s", repository)
+
+		if err := provisioner.Package("curl gnupg ca-certificates", pkgaction.Install); err != nil {
+			return err
+		}
+
+		if _, err := provisioner.SSHCommand(fmt.Sprintf("sudo mkdir -p %s && %scurl -fsSL %sRelease.key | gpg --dearmor | sudo tee %s > /dev/null", path.Dir(kubicKeyring), proxyPrefix(provisioner.EngineOptions), repository, kubicKeyring)); err != nil {
+			return err
+		}
+
+		if _, err := provisioner.SSHCommand(fmt.Sprintf("echo 'deb [signed-by=%s] %s /' | sudo tee %s", kubicKeyring, repository, kubicSourcesList)); err != nil {
+			return err
+		}
+	}
+
+	return provisioner.Package("podman", pkgaction.Install)
+}
+
+func (provisioner *DebianProvisioner) Provision(authOptions auth.Options, engineOptions engine.Options) error {
+	var (
+		err error
+	)
+
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+
+	if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
+		return err
+	}
+
+	for _, pkg := range provisioner.Packages {
+		log.Debugf("installing base package: name=%s", pkg)
+		if err := provisioner.Package(pkg, pkgaction.Install); err != nil {
+			return err
+		}
+	}
+
+	if err := provisioner.installPodman(); err != nil {
+		return err
+	}
+
+	if err := configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
+	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
+
+	if err := ConfigureAuth(provisioner); err != nil {
+		return err
+	}
+
+	return err
+}
@@ -0,0 +1,91 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebianCompatibleWithHost(t *testing.T) {
+	testCases := []struct {
+		osRelease  OsRelease
+		compatible bool
+	}{
+		{OsRelease{ID: "debian"}, true},
+		{OsRelease{ID: "ubuntu", IDLike: "debian"}, true},
+		{OsRelease{ID: "linuxmint", IDLike: "ubuntu"}, true},
+		{OsRelease{ID: "raspbian", IDLike: "debian"}, true},
+		{OsRelease{ID: "fedora"}, false},
+	}
+
+	for _, tc := range testCases {
+		p := NewDebianProvisioner(&fakedriver.Driver{})
+		osRelease := tc.osRelease
+		p.SetOsReleaseInfo(&osRelease)
+
+		assert.Equal(t, tc.compatible, p.CompatibleWithHost(), "ID=%s", tc.osRelease.ID)
+	}
+}
+
+func TestDebianKubicRepository(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+
+	p.SetOsReleaseInfo(&OsRelease{ID: "ubuntu", VersionID: "20.04"})
+	assert.Equal(t, kubicRepositoryURL+"/xUbuntu_20.04/", p.kubicRepository())
+
+	p.SetOsReleaseInfo(&OsRelease{ID: "debian", VersionID: "10"})
+	assert.Equal(t, kubicRepositoryURL+"/Debian_10/", p.kubicRepository())
+}
+
+func TestDebianPackage(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo " + aptGetArgs + " update":       "",
+			"sudo " + aptGetArgs + " install htop": "",
+			"sudo " + aptGetArgs + " purge htop":   "",
+		},
+	}
+
+	assert.NoError(t, p.Package("htop", pkgaction.Install))
+	assert.NoError(t, p.Package("htop", pkgaction.Purge))
+}
+
+func TestDebianPackageVersion(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"dpkg-query --show --showformat '${Version}' podman":                      "4.3.1+ds1-5\n",
+			"sudo " + aptGetArgs + " update":                                          "",
+			"sudo " + aptGetArgs + " install --allow-downgrades podman=3.0.1+dfsg1-3": "",
+		},
+	}
+
+	version, err := p.PackageVersion("podman")
+	assert.NoError(t, err)
+	assert.Equal(t, "4.3.1+ds1-5", version)
+
+	assert.NoError(t, p.InstallPackageVersion("podman", "3.0.1+dfsg1-3"))
+}
+
+func TestDebianInstallPodmanFromKubic(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+	p.SetOsReleaseInfo(&OsRelease{ID: "debian", VersionID: "10"})
+	repository := kubicRepositoryURL + "/Debian_10/"
+
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo " + aptGetArgs + " update":                             "",
+			"apt-cache policy podman | grep Candidate || true":           "  Candidate: (none)\n",
+			"sudo " + aptGetArgs + " install curl gnupg ca-certificates": "",
+			"sudo mkdir -p /etc/apt/keyrings && curl -fsSL " + repository + "Release.key | gpg --dearmor | sudo tee " + kubicKeyring + " > /dev/null": "",
+			"echo 'deb [signed-by=" + kubicKeyring + "] " + repository + " /' | sudo tee " + kubicSourcesList:                                         "",
+			"sudo " + aptGetArgs + " install podman": "",
+		},
+	}
+
+	assert.NoError(t, p.installPodman())
+}
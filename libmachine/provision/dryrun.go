@@ -0,0 +1,304 @@
+package provision
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+)
+
+// dryRunProvisioner is implemented by provisioners which can report what
+// Provision would do without changing the machine.
+type dryRunProvisioner interface {
+	// setOptions stores the options like Provision does
+	setOptions(authOptions auth.Options, engineOptions engine.Options)
+
+	// plannedSteps describes the changes Provision makes to the machine
+	// besides its packages and files
+	plannedSteps() []string
+
+	// plannedPackages lists the packages Provision installs
+	plannedPackages() []string
+
+	// plannedFiles lists the files Provision writes besides the Podman
+	// configuration
+	plannedFiles() []podmanConfigFile
+}
+
+func (provisioner *GenericProvisioner) setOptions(authOptions auth.Options, engineOptions engine.Options) {
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+}
+
+func (provisioner *GenericProvisioner) plannedSteps() []string {
+	return nil
+}
+
+func (provisioner *GenericProvisioner) plannedPackages() []string {
+	return append([]string{}, provisioner.Packages...)
+}
+
+func (provisioner *GenericProvisioner) plannedFiles() []podmanConfigFile {
+	return nil
+}
+
+func (provisioner *DebianProvisioner) plannedPackages() []string {
+	return withPodman(provisioner.Packages)
+}
+
+func (provisioner *SUSEProvisioner) plannedSteps() []string {
+	steps := []string{}
+	if provisioner.OsReleaseInfo.ID == "sles" {
+		steps = append(steps, "module sle-module-containers: enabled, unless podman is available")
+	}
+
+	return append(steps, "service podman.socket: enabled and started")
+}
+
+func (provisioner *SUSEProvisioner) plannedPackages() []string {
+	return withPodman(provisioner.Packages)
+}
+
+func (provisioner *AlpineProvisioner) plannedSteps() []string {
+	return []string{
+		"repository community: enabled",
+		"service cgroups: enabled and started",
+	}
+}
+
+func (provisioner *CoreOSProvisioner) plannedSteps() []string {
+	return []string{"service podman.socket: enabled and started"}
+}
+
+func (provisioner *CoreOSProvisioner) plannedFiles() []podmanConfigFile {
+	if dropIn, ok := provisioner.rpmOstreeProxyDropIn(); ok {
+		return []podmanConfigFile{dropIn}
+	}
+	return nil
+}
+
+func (provisioner *Boot2PodmanProvisioner) setOptions(authOptions auth.Options, engineOptions engine.Options) {
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+}
+
+func (provisioner *Boot2PodmanProvisioner) plannedSteps() []string {
+	return nil
+}
+
+func (provisioner *Boot2PodmanProvisioner) plannedPackages() []string {
+	// podman is part of the ISO
+	return nil
+}
+
+func (provisioner *Boot2PodmanProvisioner) plannedFiles() []podmanConfigFile {
+	return nil
+}
+
+// withPodman appends podman to the base packages, for the provisioners
+// which install it after them.
+func withPodman(packages []string) []string {
+	planned := []string{}
+	for _, pkg := range packages {
+		if pkg != "podman" {
+			planned = append(planned, pkg)
+		}
+	}
+
+	return append(planned, "podman")
+}
+
+// DryRun writes what Provision would change on the machine to w: the
+// hostname, the other steps of the provisioner, the packages, a diff of each
+// file against its current content on the machine, and the setup of
+// Podman which follows.
+func DryRun(p Provisioner, authOptions auth.Options, engineOptions engine.Options, w io.Writer) error {
+	dp, ok := p.(dryRunProvisioner)
+	if !ok {
+		return fmt.Errorf("The %s provisioner does not support dry runs", p.String())
+	}
+
+	dp.setOptions(authOptions, engineOptions)
+	authOptions = setRemoteAuthOptions(p)
+	dp.setOptions(authOptions, engineOptions)
+
+	hostname, err := p.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname = strings.TrimSpace(hostname)
+
+	machineName := p.GetDriver().GetMachineName()
+	if hostname == machineName {
+		fmt.Fprintf(w, "hostname: %s (unchanged)\n", machineName)
+	} else {
+		fmt.Fprintf(w, "hostname: %s -> %s\n", hostname, machineName)
+	}
+
+	for _, step := range dp.plannedSteps() {
+		fmt.Fprintln(w, step)
+	}
+
+	for _, pkg := range dp.plannedPackages() {
+		// most packages provide a command of the same name
+		if _, err := p.SSHCommand(fmt.Sprintf("command -v %s", pkg)); err == nil {
+			fmt.Fprintf(w, "package %s: installed\n", pkg)
+		} else {
+			fmt.Fprintf(w, "package %s: to install\n", pkg)
+		}
+	}
+
+	files := dp.plannedFiles()
+
+	configFiles, err := podmanConfigFiles(p, engineOptions)
+	if err != nil {
+		return err
+	}
+	files = append(files, configFiles...)
+
+	caCert, err := ioutil.ReadFile(authOptions.CaCertPath)
+	if err != nil {
+		return err
+	}
+	files = append(files, podmanConfigFile{authOptions.CaCertRemotePath, string(caCert)})
+
+	for _, file := range files {
+		if err := writeFileDiff(p, file, w); err != nil {
+			return err
+		}
+	}
+
+	if ts, ok := p.(caTrustStore); ok && trustsMachineWide(engineOptions) && ts.updateCATrustCommand() != "" {
+		fmt.Fprintf(w, "CA trust: updated with %s\n", ts.updateCATrustCommand())
+	}
+
+	if engineOptions.Rootless {
+		fmt.Fprintf(w, "rootless podman for %s: subordinate ids, lingering, storage.conf and podman.socket\n", p.GetDriver().GetSSHUsername())
+	}
+
+	// a new server certificate is generated on every provision
+	fmt.Fprintf(w, "%s: regenerated\n", authOptions.ServerCertRemotePath)
+	fmt.Fprintf(w, "%s: regenerated\n", authOptions.ServerKeyRemotePath)
+
+	return nil
+}
+
+// DryRunUserProvisioning writes what the provisioning given at creation
+// would change on the machine to w: the registry credentials, a diff of the
+// copied files and the scripts to run.
+func DryRunUserProvisioning(p Provisioner, syncRegistryAuth bool, authFile string, copyFiles, scripts []string, w io.Writer) error {
+	if syncRegistryAuth {
+		if authFile == "" {
+			authFile = DefaultRegistryAuthFile()
+		}
+		fmt.Fprintf(w, "registry credentials: copied from %s\n", authFile)
+	}
+
+	for _, spec := range copyFiles {
+		local, remote, _, err := ParseCopyFile(spec)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(local)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFileDiff(p, podmanConfigFile{remote, string(content)}, w); err != nil {
+			return err
+		}
+	}
+
+	for _, script := range scripts {
+		fmt.Fprintf(w, "script %s: to run\n", script)
+	}
+
+	return nil
+}
+
+func writeFileDiff(p SSHCommander, file podmanConfigFile, w io.Writer) error {
+	current := ""
+	if _, err := p.SSHCommand(fmt.Sprintf("sudo test -f %s", file.Path)); err != nil {
+		fmt.Fprintf(w, "%s: new file\n", file.Path)
+	} else {
+		current, err = p.SSHCommand(fmt.Sprintf("sudo cat %s", file.Path))
+		if err != nil {
+			return err
+		}
+
+		if current == file.Content {
+			fmt.Fprintf(w, "%s: unchanged\n", file.Path)
+			return nil
+		}
+
+		fmt.Fprintf(w, "%s: changed\n", file.Path)
+	}
+
+	fmt.Fprintf(w, "--- %s (current)\n+++ %s (planned)\n", file.Path, file.Path)
+	for _, line := range diffLines(current, file.Content) {
+		fmt.Fprintln(w, line)
+	}
+
+	return nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines compares two texts line by line, and returns the lines of both
+// prefixed with " " when they are common, "-" when only in a and "+" when
+// only in b.
+func diffLines(a, b string) []string {
+	linesA, linesB := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// linesA[i:] and linesB[j:]
+	lcs := make([][]int, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			if linesA[i] == linesB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []string{}
+	i, j := 0, 0
+	for i < len(linesA) && j < len(linesB) {
+		switch {
+		case linesA[i] == linesB[j]:
+			diff = append(diff, " "+linesA[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+linesA[i])
+			i++
+		default:
+			diff = append(diff, "+"+linesB[j])
+			j++
+		}
+	}
+	for ; i < len(linesA); i++ {
+		diff = append(diff, "-"+linesA[i])
+	}
+	for ; j < len(linesB); j++ {
+		diff = append(diff, "+"+linesB[j])
+	}
+
+	return diff
+}
@@ -0,0 +1,151 @@
+package provision
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, []string{" a", "-b", "+B", " c", "+d"}, diffLines("a\nb\nc\n", "a\nB\nc\nd\n"))
+	assert.Equal(t, []string{"+a"}, diffLines("", "a\n"))
+	assert.Equal(t, []string{" a"}, diffLines("a", "a\n"))
+}
+
+func TestDryRun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	caCertPath := filepath.Join(tmpDir, "ca.pem")
+	if err := ioutil.WriteFile(caCertPath, []byte("CA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewDebianProvisioner(&fakedriver.Driver{MockName: "box"}).(*DebianProvisioner)
+	p.EngineOptionsDir = "/etc/machine"
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"hostname": "debian\n",
+			"sudo test -f /etc/containers/containers.conf": "",
+			"sudo cat /etc/containers/containers.conf":     "[containers]\n\n[engine]\nevents_logger = \"file\"\n",
+			"sudo test -f /etc/machine/ca.pem":             "",
+			"sudo cat /etc/machine/ca.pem":                 "CA\n",
+		},
+	}
+
+	var out bytes.Buffer
+	err = DryRun(p, auth.Options{CaCertPath: caCertPath}, engine.Options{}, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `hostname: debian -> box
+package podman: to install
+/etc/containers/containers.conf: changed
+--- /etc/containers/containers.conf (current)
++++ /etc/containers/containers.conf (planned)
+ [containers]
+ 
+ [engine]
+-events_logger = "file"
++events_logger = "journald"
+/etc/machine/ca.pem: unchanged
+/etc/machine/server.pem: regenerated
+/etc/machine/server-key.pem: regenerated
+`, out.String())
+}
+
+func TestDryRunAlpine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	caCertPath := filepath.Join(tmpDir, "ca.pem")
+	if err := ioutil.WriteFile(caCertPath, []byte("CA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewAlpineProvisioner(&fakedriver.Driver{MockName: "box"}).(*AlpineProvisioner)
+	p.EngineOptionsDir = "/etc/machine"
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"hostname":          "box\n",
+			"command -v podman": "/usr/bin/podman\n",
+		},
+	}
+
+	var out bytes.Buffer
+	err = DryRun(p, auth.Options{CaCertPath: caCertPath}, engine.Options{}, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `hostname: box (unchanged)
+repository community: enabled
+service cgroups: enabled and started
+package podman: installed
+/etc/containers/containers.conf: new file
+--- /etc/containers/containers.conf (current)
++++ /etc/containers/containers.conf (planned)
++[containers]
++
++[engine]
++events_logger = "file"
+/etc/machine/ca.pem: new file
+--- /etc/machine/ca.pem (current)
++++ /etc/machine/ca.pem (planned)
++CA
+/etc/machine/server.pem: regenerated
+/etc/machine/server-key.pem: regenerated
+`, out.String())
+}
+
+func TestDryRunCoreOS(t *testing.T) {
+	p := NewCoreOSProvisioner(&fakedriver.Driver{}).(*CoreOSProvisioner)
+	p.setOptions(auth.Options{}, engine.Options{HTTPSProxy: "http://proxy:3128"})
+
+	assert.Empty(t, p.plannedPackages())
+	assert.Equal(t, []string{"service podman.socket: enabled and started"}, p.plannedSteps())
+	assert.Equal(t, []podmanConfigFile{
+		{"/etc/systemd/system/rpm-ostreed.service.d/proxy.conf", "[Service]\nEnvironment=\"HTTPS_PROXY=http://proxy:3128\"\nEnvironment=\"https_proxy=http://proxy:3128\"\n"},
+	}, p.plannedFiles())
+}
+
+func TestDryRunUserProvisioning(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	local := filepath.Join(tmpDir, "motd")
+	if err := ioutil.WriteFile(local, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo test -f /etc/motd": "",
+			"sudo cat /etc/motd":     "hello\n",
+		},
+	}
+
+	var out bytes.Buffer
+	err = DryRunUserProvisioning(p, true, "/home/user/auth.json", []string{local + ":/etc/motd"}, []string{"setup.sh"}, &out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `registry credentials: copied from /home/user/auth.json
+/etc/motd: unchanged
+script setup.sh: to run
+`, out.String())
+}
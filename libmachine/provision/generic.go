@@ -98,8 +98,6 @@ ENGINE_OPTS='
 --tlscert {{.AuthOptions.ServerCertRemotePath}}
 --tlskey {{.AuthOptions.ServerKeyRemotePath}}
 {{ range .EngineOptions.Labels }}--label {{.}}
-{{ end }}{{ range .EngineOptions.InsecureRegistry }}--insecure-registry {{.}}
-{{ end }}{{ range .EngineOptions.RegistryMirror }}--registry-mirror {{.}}
 {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}}
 {{ end }}
 '
@@ -0,0 +1,51 @@
+package provision
+
+import (
+	"fmt"
+
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/provision/serviceaction"
+)
+
+type OpenRCProvisioner struct {
+	GenericProvisioner
+}
+
+func (p *OpenRCProvisioner) String() string {
+	return "openrc"
+}
+
+func NewOpenRCProvisioner(osReleaseID string, d drivers.Driver) OpenRCProvisioner {
+	return OpenRCProvisioner{
+		GenericProvisioner{
+			SSHCommander: GenericSSHCommander{Driver: d},
+
+			OsReleaseID: osReleaseID,
+			Packages:    []string{},
+			Driver:      d,
+		},
+	}
+}
+
+func (p *OpenRCProvisioner) Service(name string, action serviceaction.ServiceAction) error {
+	var command string
+
+	switch action {
+	case serviceaction.Enable:
+		command = fmt.Sprintf("sudo rc-update add %s default", name)
+	case serviceaction.Disable:
+		command = fmt.Sprintf("sudo rc-update del %s default", name)
+	case serviceaction.DaemonReload:
+		// OpenRC reads the init scripts on every call, there is
+		// nothing to reload
+		return nil
+	default:
+		command = fmt.Sprintf("sudo rc-service %s %s", name, action.String())
+	}
+
+	if _, err := p.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package provision
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+const (
+	registriesConfPath = "/etc/containers/registries.conf"
+	storageConfPath    = "/etc/containers/storage.conf"
+	containersConfPath = "/etc/containers/containers.conf"
+
+	// podmanLogLevelDropIn overrides the LOGGING variable of the podman
+	// service unit shipped by Podman
+	podmanLogLevelDropIn = "podman.service.d/log-level.conf"
+
+	defaultRunRoot   = "/run/containers/storage"
+	defaultGraphRoot = "/var/lib/containers/storage"
+
+	// registry-mirror has always meant a mirror of Docker Hub
+	defaultRegistry = "docker.io"
+)
+
+// podmanConfigFile is a configuration file rendered from the engine options.
+type podmanConfigFile struct {
+	Path    string
+	Content string
+}
+
+// systemdHost is implemented by the provisioners of hosts running systemd.
+type systemdHost interface {
+	systemdUnitDir() string
+}
+
+// podmanConfigFiles returns the configuration files which carry the engine
+// options over to Podman, along with the CA certificates to trust. Files
+// with nothing to configure are left out, so that the defaults of the
+// distribution stay in place. containers.conf is always written, but Podman
+// merges it key by key with the defaults.
+func podmanConfigFiles(p Provisioner, engineOptions engine.Options) ([]podmanConfigFile, error) {
+	files := []podmanConfigFile{}
+
+	if registriesConf := generateRegistriesConf(engineOptions); registriesConf != "" {
+		files = append(files, podmanConfigFile{registriesConfPath, registriesConf})
+	}
+
+	storageConf, err := generateStorageConf(p, engineOptions)
+	if err != nil {
+		return nil, err
+	}
+	if storageConf != "" {
+		files = append(files, podmanConfigFile{storageConfPath, storageConf})
+	}
+
+	files = append(files, podmanConfigFile{containersConfPath, generateContainersConf(p, engineOptions)})
+
+	// The log level is a flag of each podman invocation rather than a
+	// containers.conf setting, so it is only applied to the API service,
+	// which on boot2podman and OpenRC hosts takes no such configuration
+	if sh, ok := p.(systemdHost); ok && engineOptions.LogLevel != "" {
+		files = append(files, podmanConfigFile{
+			path.Join(sh.systemdUnitDir(), podmanLogLevelDropIn),
+			fmt.Sprintf("[Service]\nEnvironment=LOGGING=\"--log-level=%s\"\n", engineOptions.LogLevel),
+		})
+	}
+
+	caFiles, err := trustedCAFiles(p, engineOptions)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, caFiles...)
+
+	return files, nil
+}
+
+// configurePodman writes the Podman configuration files to the machine.
+func configurePodman(p Provisioner, engineOptions engine.Options) error {
+	if _, ok := p.(systemdHost); engineOptions.Rootless && !ok {
+		return fmt.Errorf("Rootless mode needs systemd, which the %s provisioner does not use", p.String())
+	}
+
+	if len(engineOptions.Labels) > 0 {
+		// Docker daemon labels describe the engine, Podman has nothing alike
+		log.Warnf("Ignoring --engine-label, Podman has no engine labels")
+	}
+
+	files, err := podmanConfigFiles(p, engineOptions)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		log.Debugf("writing podman configuration: %s", file.Path)
+		if err := WriteRemoteFile(p, file.Path, file.Content); err != nil {
+			return fmt.Errorf("Error writing %s: %s", file.Path, err)
+		}
+	}
+
+	if err := updateCATrust(p, engineOptions); err != nil {
+		return err
+	}
+
+	if _, ok := p.(systemdHost); ok {
+		// pick up the service drop-ins
+		if _, err := p.SSHCommand("sudo systemctl daemon-reload"); err != nil {
+			return err
+		}
+	}
+
+	if engineOptions.Rootless {
+		return configureRootless(p, engineOptions)
+	}
+
+	return nil
+}
+
+// registryLocation strips the scheme from a registry URL, registries.conf
+// only wants the host, port and optional namespace. Registries reached over
+// plain http have to be insecure.
+func registryLocation(registry string) (string, bool) {
+	insecure := strings.HasPrefix(registry, "http://")
+
+	for _, scheme := range []string{"http://", "https://"} {
+		registry = strings.TrimPrefix(registry, scheme)
+	}
+
+	return strings.TrimSuffix(registry, "/"), insecure
+}
+
+// generateRegistriesConf renders a registries.conf in the version 2 format
+// from the insecure registries and registry mirrors.
+func generateRegistriesConf(engineOptions engine.Options) string {
+	if len(engineOptions.InsecureRegistry) == 0 && len(engineOptions.RegistryMirror) == 0 {
+		return ""
+	}
+
+	insecure := map[string]bool{}
+	for _, registry := range engineOptions.InsecureRegistry {
+		location, _ := registryLocation(registry)
+		insecure[location] = true
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "unqualified-search-registries = %s\n", tomlStringArray([]string{defaultRegistry}))
+
+	if len(engineOptions.RegistryMirror) > 0 {
+		fmt.Fprintf(&buf, "\n[[registry]]\nlocation = %s\n", tomlString(defaultRegistry))
+
+		for _, mirror := range engineOptions.RegistryMirror {
+			location, plainHTTP := registryLocation(mirror)
+
+			fmt.Fprintf(&buf, "\n[[registry.mirror]]\nlocation = %s\n", tomlString(location))
+			if plainHTTP || insecure[location] {
+				buf.WriteString("insecure = true\n")
+			}
+
+			// a mirror does not need its own entry below
+			delete(insecure, location)
+		}
+	}
+
+	for _, registry := range engineOptions.InsecureRegistry {
+		location, _ := registryLocation(registry)
+		if !insecure[location] {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n[[registry]]\nlocation = %s\ninsecure = true\n", tomlString(location))
+		delete(insecure, location)
+	}
+
+	return buf.String()
+}
+
+// generateStorageConf renders a storage.conf from the storage driver, graph
+// directory and storage options. Options are given as key=value, where keys
+// prefixed with "overlay." go to the overlay driver section, "runroot" and
+// "graphroot" to the storage section, and anything else to the generic
+// options section.
+func generateStorageConf(p Provisioner, engineOptions engine.Options) (string, error) {
+	if engineOptions.StorageDriver == "" && engineOptions.GraphDir == "" && len(engineOptions.StorageOpts) == 0 {
+		return "", nil
+	}
+
+	suppliedDriver := engineOptions.StorageDriver
+	if suppliedDriver == "overlay2" {
+		// the Docker name of the driver
+		suppliedDriver = "overlay"
+	}
+
+	driver, err := decideStorageDriver(p, "overlay", suppliedDriver)
+	if err != nil {
+		return "", err
+	}
+
+	runRoot := defaultRunRoot
+	graphRoot := defaultGraphRoot
+	if engineOptions.GraphDir != "" {
+		graphRoot = engineOptions.GraphDir
+	}
+
+	var options, overlayOptions []string
+	for _, opt := range engineOptions.StorageOpts {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Invalid storage option %q, expected key=value", opt)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case key == "runroot":
+			runRoot = value
+		case key == "graphroot":
+			graphRoot = value
+		case strings.HasPrefix(key, "overlay."):
+			overlayOptions = append(overlayOptions, fmt.Sprintf("%s = %s\n", strings.TrimPrefix(key, "overlay."), tomlString(value)))
+		default:
+			options = append(options, fmt.Sprintf("%s = %s\n", key, tomlString(value)))
+		}
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "[storage]\ndriver = %s\nrunroot = %s\ngraphroot = %s\n", tomlString(driver), tomlString(runRoot), tomlString(graphRoot))
+
+	buf.WriteString("\n[storage.options]\n")
+	for _, option := range options {
+		buf.WriteString(option)
+	}
+
+	if len(overlayOptions) > 0 {
+		buf.WriteString("\n[storage.options.overlay]\n")
+		for _, option := range overlayOptions {
+			buf.WriteString(option)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// generateContainersConf renders a containers.conf from the engine
+// environment, DNS servers, SELinux setting and proxy.
+func generateContainersConf(p Provisioner, engineOptions engine.Options) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("[containers]\n")
+	if len(engineOptions.Env) > 0 {
+		fmt.Fprintf(&buf, "env = %s\n", tomlStringArray(engineOptions.Env))
+	}
+	if len(engineOptions.DNS) > 0 {
+		fmt.Fprintf(&buf, "dns_servers = %s\n", tomlStringArray(engineOptions.DNS))
+	}
+	// SelinuxEnabled cannot tell "disabled" from "not set", so the
+	// distribution default is kept unless it is enabled
+	if engineOptions.SelinuxEnabled {
+		buf.WriteString("label = true\n")
+	}
+
+	// journald is the Podman default, but needs systemd
+	eventsLogger := "file"
+	if _, ok := p.(systemdHost); ok {
+		eventsLogger = "journald"
+	}
+
+	fmt.Fprintf(&buf, "\n[engine]\nevents_logger = %s\n", tomlString(eventsLogger))
+	// for pulls, and passed on to containers as http_proxy defaults to true
+	if proxyEnv := proxyEnvironment(engineOptions); len(proxyEnv) > 0 {
+		fmt.Fprintf(&buf, "env = %s\n", tomlStringArray(proxyEnv))
+	}
+
+	return buf.String()
+}
+
+// tomlString quotes a TOML basic string. Go quoting is close, but escapes
+// some characters in ways TOML does not accept, such as \x00 or \U0001F600.
+func tomlString(value string) string {
+	var buf bytes.Buffer
+
+	buf.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&buf, `\u%04X`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
+
+func tomlStringArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = tomlString(value)
+	}
+
+	return fmt.Sprintf("[%s]", strings.Join(quoted, ", "))
+}
@@ -0,0 +1,150 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateRegistriesConfEmpty(t *testing.T) {
+	assert.Empty(t, generateRegistriesConf(engine.Options{}))
+}
+
+func TestPodmanConfigFilesDefaults(t *testing.T) {
+	files, err := podmanConfigFiles(&fakeProvisioner{}, engine.Options{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []podmanConfigFile{
+		{containersConfPath, "[containers]\n\n[engine]\nevents_logger = \"file\"\n"},
+	}, files)
+}
+
+func TestPodmanConfigFilesLogLevel(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{})
+
+	files, err := podmanConfigFiles(p, engine.Options{LogLevel: "debug"})
+
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, podmanConfigFile{
+		"/etc/systemd/system/podman.service.d/log-level.conf",
+		"[Service]\nEnvironment=LOGGING=\"--log-level=debug\"\n",
+	}, files[1])
+}
+
+func TestGenerateContainersConf(t *testing.T) {
+	p := NewCoreOSProvisioner(&fakedriver.Driver{})
+
+	conf := generateContainersConf(p, engine.Options{
+		Env:            []string{"HTTP_PROXY=http://proxy:3128", "TZ=UTC"},
+		DNS:            []string{"10.0.0.2"},
+		SelinuxEnabled: true,
+	})
+
+	assert.Equal(t, `[containers]
+env = ["HTTP_PROXY=http://proxy:3128", "TZ=UTC"]
+dns_servers = ["10.0.0.2"]
+label = true
+
+[engine]
+events_logger = "journald"
+`, conf)
+}
+
+func TestGenerateContainersConfBoot2Podman(t *testing.T) {
+	p := NewBoot2PodmanProvisioner(&fakedriver.Driver{})
+
+	conf := generateContainersConf(p, engine.Options{})
+
+	assert.Equal(t, "[containers]\n\n[engine]\nevents_logger = \"file\"\n", conf)
+}
+
+func TestGenerateRegistriesConf(t *testing.T) {
+	conf := generateRegistriesConf(engine.Options{
+		InsecureRegistry: []string{"registry.dev:5000", "http://mirror.internal/", "registry.dev:5000"},
+		RegistryMirror:   []string{"https://mirror.internal", "http://cache.internal:5000"},
+	})
+
+	assert.Equal(t, `unqualified-search-registries = ["docker.io"]
+
+[[registry]]
+location = "docker.io"
+
+[[registry.mirror]]
+location = "mirror.internal"
+insecure = true
+
+[[registry.mirror]]
+location = "cache.internal:5000"
+insecure = true
+
+[[registry]]
+location = "registry.dev:5000"
+insecure = true
+`, conf)
+}
+
+func TestGenerateRegistriesConfMirrorOnly(t *testing.T) {
+	conf := generateRegistriesConf(engine.Options{
+		RegistryMirror: []string{"https://mirror.gcr.io"},
+	})
+
+	assert.Equal(t, `unqualified-search-registries = ["docker.io"]
+
+[[registry]]
+location = "docker.io"
+
+[[registry.mirror]]
+location = "mirror.gcr.io"
+`, conf)
+}
+
+func TestGenerateStorageConf(t *testing.T) {
+	p := &fakeProvisioner{GenericProvisioner{
+		Driver:       &fakedriver.Driver{},
+		SSHCommander: provisiontest.NewFakeSSHCommander(provisiontest.FakeSSHCommanderOptions{}),
+	}}
+
+	conf, err := generateStorageConf(p, engine.Options{
+		StorageDriver: "overlay2",
+		GraphDir:      "/mnt/data/containers",
+		StorageOpts: []string{
+			"overlay.mountopt=nodev,metacopy=on",
+			"size=10G",
+			"runroot=/run/storage",
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `[storage]
+driver = "overlay"
+runroot = "/run/storage"
+graphroot = "/mnt/data/containers"
+
+[storage.options]
+size = "10G"
+
+[storage.options.overlay]
+mountopt = "nodev,metacopy=on"
+`, conf)
+}
+
+func TestGenerateStorageConfInvalidOption(t *testing.T) {
+	_, err := generateStorageConf(&fakeProvisioner{}, engine.Options{
+		StorageDriver: "vfs",
+		StorageOpts:   []string{"metacopy"},
+	})
+
+	assert.EqualError(t, err, `Invalid storage option "metacopy", expected key=value`)
+}
+
+func TestTomlString(t *testing.T) {
+	assert.Equal(t, `"overlay"`, tomlString("overlay"))
+	assert.Equal(t, `"a \"b\" c:\\d"`, tomlString(`a "b" c:\d`))
+	assert.Equal(t, `"line\nnext\ttab\u0000\u001B\u007F"`, tomlString("line\nnext\ttab\x00\x1b\x7f"))
+	assert.Equal(t, `"😀é"`, tomlString("😀é"))
+	assert.Equal(t, `["a=1", "b=\"2\""]`, tomlStringArray([]string{"a=1", `b="2"`}))
+}
@@ -2,6 +2,8 @@ package provision
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/thelonelyghost/p2box/libmachine/auth"
 	"github.com/thelonelyghost/p2box/libmachine/drivers"
@@ -78,27 +80,100 @@ type Provisioner interface {
 	GetOsReleaseInfo() (*OsRelease, error)
 }
 
+// VersionedPackager is implemented by the provisioners which can install a
+// given version of a package, for pinned upgrades and rollbacks.
+type VersionedPackager interface {
+	// Get the installed version of a package
+	PackageVersion(name string) (string, error)
+
+	// Install the given version of a package, downgrading it if needed
+	InstallPackageVersion(name, version string) error
+}
+
+// PackageRollbacker is implemented by the provisioners which keep what they
+// replace on upgrade, and so roll back without reinstalling a version.
+type PackageRollbacker interface {
+	// Return a package to the version it had before the last upgrade
+	RollbackPackage(name string) error
+}
+
 // RegisteredProvisioner creates a new provisioner
 type RegisteredProvisioner struct {
 	New func(d drivers.Driver) Provisioner
+
+	// Provisioners with a higher priority are tried first during
+	// detection. Ties are broken by name.
+	Priority int
 }
 
 func Register(name string, p *RegisteredProvisioner) {
 	provisioners[name] = p
 }
 
+// Names returns the registered provisioners, in the order they are tried
+// during detection.
+func Names() []string {
+	names := make([]string, 0, len(provisioners))
+	for name := range provisioners {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := provisioners[names[i]].Priority, provisioners[names[j]].Priority
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+func lookupProvisioner(name string) (*RegisteredProvisioner, bool) {
+	for registeredName, p := range provisioners {
+		if strings.EqualFold(registeredName, name) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// IsRegistered tells whether a provisioner exists with the given name,
+// ignoring case.
+func IsRegistered(name string) bool {
+	_, ok := lookupProvisioner(name)
+	return ok
+}
+
 func DetectProvisioner(d drivers.Driver) (Provisioner, error) {
 	return detector.DetectProvisioner(d)
 }
 
-func (detector StandardDetector) DetectProvisioner(d drivers.Driver) (Provisioner, error) {
+// ProvisionerByName returns the named provisioner without checking whether
+// it is compatible with the host.
+func ProvisionerByName(name string, d drivers.Driver) (Provisioner, error) {
+	p, ok := lookupProvisioner(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown provisioner %q, must be one of: %s", name, strings.Join(Names(), ", "))
+	}
+
+	osReleaseInfo, err := getOsRelease(d)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioner := p.New(d)
+	provisioner.SetOsReleaseInfo(osReleaseInfo)
+
+	return provisioner, nil
+}
+
+func getOsRelease(d drivers.Driver) (*OsRelease, error) {
 	log.Info("Waiting for SSH to be available...")
 	if err := drivers.WaitForSSH(d); err != nil {
 		return nil, err
 	}
 
-	log.Info("Detecting the provisioner...")
-
 	osReleaseOut, err := drivers.RunSSHCommandFromDriver(d, "cat /etc/os-release")
 	if err != nil {
 		return nil, fmt.Errorf("Error getting SSH command: %s", err)
@@ -109,15 +184,52 @@ func (detector StandardDetector) DetectProvisioner(d drivers.Driver) (Provisione
 		return nil, fmt.Errorf("Error parsing /etc/os-release file: %s", err)
 	}
 
-	for _, p := range provisioners {
-		provisioner := p.New(d)
-		provisioner.SetOsReleaseInfo(osReleaseInfo)
+	return osReleaseInfo, nil
+}
 
-		if provisioner.CompatibleWithHost() {
-			log.Debugf("found compatible host: %s", osReleaseInfo.ID)
+func (detector StandardDetector) DetectProvisioner(d drivers.Driver) (Provisioner, error) {
+	osReleaseInfo, err := getOsRelease(d)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Detecting the provisioner...")
+
+	return detectFromOsRelease(d, osReleaseInfo)
+}
+
+func detectFromOsRelease(d drivers.Driver, osReleaseInfo *OsRelease) (Provisioner, error) {
+	if provisioner := findCompatible(d, osReleaseInfo); provisioner != nil {
+		log.Debugf("found compatible host: %s", osReleaseInfo.ID)
+		return provisioner, nil
+	}
+
+	// Derivatives such as Rocky or AlmaLinux are only recognized through
+	// the distributions they list in ID_LIKE, most similar first
+	for _, id := range strings.Fields(osReleaseInfo.IDLike) {
+		like := *osReleaseInfo
+		like.ID = id
+
+		if provisioner := findCompatible(d, &like); provisioner != nil {
+			log.Debugf("found compatible host: %s (like %s)", osReleaseInfo.ID, id)
+			// the provisioner still works with the real distribution
+			provisioner.SetOsReleaseInfo(osReleaseInfo)
 			return provisioner, nil
 		}
 	}
 
 	return nil, ErrDetectionFailed
 }
+
+func findCompatible(d drivers.Driver, osReleaseInfo *OsRelease) Provisioner {
+	for _, name := range Names() {
+		provisioner := provisioners[name].New(d)
+		provisioner.SetOsReleaseInfo(osReleaseInfo)
+
+		if provisioner.CompatibleWithHost() {
+			return provisioner
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamesOrder(t *testing.T) {
+	names := Names()
+
+	// CoreOS has a higher priority, the rest is sorted by name
+	assert.Equal(t, "CoreOS", names[0])
+	assert.Equal(t, []string{"Alpine", "Centos", "Debian", "Fedora", "RedHat", "SUSE", "boot2podman"}, names[1:])
+}
+
+func TestDetectFromOsRelease(t *testing.T) {
+	cases := []struct {
+		release  *OsRelease
+		expected string
+	}{
+		{&OsRelease{ID: "centos", IDLike: "rhel fedora"}, "centos"},
+		{&OsRelease{ID: "fedora", VariantID: "coreos"}, "coreos"},
+		{&OsRelease{ID: "rocky", IDLike: "rhel centos fedora"}, "redhat"},
+		{&OsRelease{ID: "almalinux", IDLike: "rhel centos fedora"}, "redhat"},
+		{&OsRelease{ID: "ol", IDLike: "fedora"}, "fedora"},
+		{&OsRelease{ID: "linuxmint", IDLike: "ubuntu debian"}, "debian"},
+	}
+
+	for _, c := range cases {
+		provisioner, err := detectFromOsRelease(&fakedriver.Driver{}, c.release)
+		assert.NoError(t, err, c.release.ID)
+		assert.Equal(t, c.expected, provisioner.String(), c.release.ID)
+
+		info, err := provisioner.GetOsReleaseInfo()
+		assert.NoError(t, err, c.release.ID)
+		assert.Equal(t, c.release, info, c.release.ID)
+	}
+}
+
+func TestDetectFromOsReleasePriority(t *testing.T) {
+	Register("Zdebian", &RegisteredProvisioner{
+		New: func(d drivers.Driver) Provisioner {
+			return &fakeProvisioner{GenericProvisioner{OsReleaseID: "debian", Driver: d}}
+		},
+		Priority: 5,
+	})
+	defer delete(provisioners, "Zdebian")
+
+	provisioner, err := detectFromOsRelease(&fakedriver.Driver{}, &OsRelease{ID: "debian"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fake", provisioner.String())
+
+	// on a tie, the name decides
+	provisioners["Zdebian"].Priority = 0
+
+	provisioner, err = detectFromOsRelease(&fakedriver.Driver{}, &OsRelease{ID: "debian"})
+	assert.NoError(t, err)
+	assert.Equal(t, "debian", provisioner.String())
+}
+
+func TestDetectFromOsReleaseFailed(t *testing.T) {
+	_, err := detectFromOsRelease(&fakedriver.Driver{}, &OsRelease{ID: "plan9", IDLike: "unix"})
+
+	assert.Equal(t, ErrDetectionFailed, err)
+}
+
+func TestIsRegistered(t *testing.T) {
+	assert.True(t, IsRegistered("debian"))
+	assert.True(t, IsRegistered("CoreOS"))
+	assert.False(t, IsRegistered("plan9"))
+}
@@ -0,0 +1,45 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+)
+
+// proxyEnvironment returns the proxy settings of the engine options as
+// environment variables, in both cases since tools disagree on which one
+// they read.
+func proxyEnvironment(engineOptions engine.Options) []string {
+	env := []string{}
+
+	for _, v := range []struct {
+		name  string
+		value string
+	}{
+		{"http_proxy", engineOptions.HTTPProxy},
+		{"https_proxy", engineOptions.HTTPSProxy},
+		{"no_proxy", engineOptions.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%s", strings.ToUpper(v.name), v.value))
+		env = append(env, fmt.Sprintf("%s=%s", v.name, v.value))
+	}
+
+	return env
+}
+
+// proxyPrefix returns the proxy settings as variable assignments to put in
+// front of a command, or after sudo and its options. It is empty without a
+// proxy.
+func proxyPrefix(engineOptions engine.Options) string {
+	prefix := ""
+	for _, v := range proxyEnvironment(engineOptions) {
+		parts := strings.SplitN(v, "=", 2)
+		prefix += fmt.Sprintf("%s=%s ", parts[0], shellQuote(parts[1]))
+	}
+
+	return prefix
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"strings"
 	"text/template"
 
 	"github.com/thelonelyghost/p2box/libmachine/auth"
@@ -16,7 +17,7 @@ import (
 
 var (
 	ErrUnknownYumOsRelease = errors.New("unknown OS for Yum repository")
-	engineConfigTemplate   = `--storage-driver {{.EngineOptions.StorageDriver}} --tlsverify --tlscacert {{.AuthOptions.CaCertRemotePath}} --tlscert {{.AuthOptions.ServerCertRemotePath}} --tlskey {{.AuthOptions.ServerKeyRemotePath}} {{ range .EngineOptions.Labels }}--label {{.}} {{ end }}{{ range .EngineOptions.InsecureRegistry }}--insecure-registry {{.}} {{ end }}{{ range .EngineOptions.RegistryMirror }}--registry-mirror {{.}} {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}} {{ end }}
+	engineConfigTemplate   = `--storage-driver {{.EngineOptions.StorageDriver}} --tlsverify --tlscacert {{.AuthOptions.CaCertRemotePath}} --tlscert {{.AuthOptions.ServerCertRemotePath}} --tlskey {{.AuthOptions.ServerKeyRemotePath}} {{ range .EngineOptions.Labels }}--label {{.}} {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}} {{ end }}
 Environment={{range .EngineOptions.Env}}{{ printf "%q" . }} {{end}}
 `
 )
@@ -86,7 +87,30 @@ func (provisioner *RedHatProvisioner) Package(name string, action pkgaction.Pack
 		packageAction = "upgrade"
 	}
 
-	command := fmt.Sprintf("sudo -E yum %s -y %s", packageAction, name)
+	command := fmt.Sprintf("sudo -E %syum %s -y %s", proxyPrefix(provisioner.EngineOptions), packageAction, name)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *RedHatProvisioner) PackageVersion(name string) (string, error) {
+	version, err := provisioner.SSHCommand(fmt.Sprintf("rpm -q --queryformat '%%{VERSION}-%%{RELEASE}' %s", name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(version), nil
+}
+
+func (provisioner *RedHatProvisioner) InstallPackageVersion(name, version string) error {
+	// install refuses to go back to an older version, which downgrade does
+	command := fmt.Sprintf(
+		"sudo -E %[1]syum install -y %[2]s-%[3]s || sudo -E %[1]syum downgrade -y %[2]s-%[3]s",
+		proxyPrefix(provisioner.EngineOptions), name, version,
+	)
 
 	if _, err := provisioner.SSHCommand(command); err != nil {
 		return err
@@ -114,6 +138,10 @@ func (provisioner *RedHatProvisioner) Provision(authOptions auth.Options, engine
 		}
 	}
 
+	if err := configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
 	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
 
 	if err := ConfigureAuth(provisioner); err != nil {
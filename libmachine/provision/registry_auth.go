@@ -0,0 +1,169 @@
+package provision
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/mcnutils"
+)
+
+// rootAuthFile is where Podman keeps the registry credentials of root, which
+// has no XDG_RUNTIME_DIR
+const rootAuthFile = "/run/containers/0/auth.json"
+
+// DefaultRegistryAuthFile returns the auth file Podman uses on this host:
+// REGISTRY_AUTH_FILE, then the one in the runtime directory, then the one
+// in the configuration directory used where there is no runtime directory.
+func DefaultRegistryAuthFile() string {
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); authFile != "" {
+		return authFile
+	}
+
+	candidates := []string{}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, "containers", "auth.json"))
+	}
+	candidates = append(candidates, filepath.Join(mcnutils.GetHomeDir(), ".config", "containers", "auth.json"))
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+
+	return candidates[0]
+}
+
+// registryAuths returns the credentials of an auth file by registry, only
+// for the given registries when there are some.
+func registryAuths(content []byte, registries []string) (map[string]json.RawMessage, error) {
+	var authFile struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err := json.Unmarshal(content, &authFile); err != nil {
+		return nil, err
+	}
+
+	if len(registries) == 0 {
+		if len(authFile.Auths) == 0 {
+			return nil, fmt.Errorf("No registry credentials found, log in with podman login first")
+		}
+		return authFile.Auths, nil
+	}
+
+	auths := map[string]json.RawMessage{}
+	for _, registry := range registries {
+		wanted, _ := registryLocation(registry)
+		found := false
+
+		// Docker writes its keys as URLs
+		for key, auth := range authFile.Auths {
+			if location, _ := registryLocation(key); location == wanted {
+				auths[key] = auth
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("No credentials for %s found, log in with podman login first", registry)
+		}
+	}
+
+	return auths, nil
+}
+
+// mergeRegistryAuths adds credentials to the content of an existing auth
+// file, keeping the other registries and settings.
+func mergeRegistryAuths(existing string, auths map[string]json.RawMessage) ([]byte, error) {
+	authFile := map[string]json.RawMessage{}
+	if strings.TrimSpace(existing) != "" {
+		if err := json.Unmarshal([]byte(existing), &authFile); err != nil {
+			log.Warnf("Replacing the unreadable auth file of the machine: %s", err)
+			authFile = map[string]json.RawMessage{}
+		}
+	}
+
+	merged := map[string]json.RawMessage{}
+	if current, ok := authFile["auths"]; ok {
+		if err := json.Unmarshal(current, &merged); err != nil {
+			merged = map[string]json.RawMessage{}
+		}
+	}
+
+	for registry, auth := range auths {
+		merged[registry] = auth
+	}
+
+	mergedAuths, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	authFile["auths"] = mergedAuths
+
+	return json.MarshalIndent(authFile, "", "\t")
+}
+
+// SyncRegistryAuth copies registry credentials from a local auth file, the
+// one of Podman when empty, to the auth file of Podman on the machine.
+// Credentials already on the machine for other registries are kept.
+func SyncRegistryAuth(p Provisioner, engineOptions engine.Options, authFile string, registries []string) error {
+	if authFile == "" {
+		authFile = DefaultRegistryAuthFile()
+	}
+
+	content, err := ioutil.ReadFile(authFile)
+	if err != nil {
+		return fmt.Errorf("Error reading registry credentials: %s", err)
+	}
+
+	auths, err := registryAuths(content, registries)
+	if err != nil {
+		return fmt.Errorf("Error reading registry credentials from %s: %s", authFile, err)
+	}
+
+	remoteFile := rootAuthFile
+	owner := "root"
+	if engineOptions.Rootless {
+		uid, err := p.SSHCommand("id -u")
+		if err != nil {
+			return err
+		}
+		remoteFile = fmt.Sprintf("/run/user/%s/containers/auth.json", strings.TrimSpace(uid))
+		owner = p.GetDriver().GetSSHUsername()
+	}
+
+	existing, err := p.SSHCommand(fmt.Sprintf("sudo cat %s 2>/dev/null || true", remoteFile))
+	if err != nil {
+		return err
+	}
+
+	merged, err := mergeRegistryAuths(existing, auths)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Copying registry credentials from %s to %s...", authFile, remoteFile)
+
+	// the directory is only opened to the owner before the credentials are
+	// written, so they are never readable by others, and is left writable
+	// for podman login on the machine
+	dir := shellQuote(path.Dir(remoteFile))
+	file := shellQuote(remoteFile)
+	encoded := base64.StdEncoding.EncodeToString(merged)
+	if _, err := p.SSHCommand(fmt.Sprintf(
+		"sudo mkdir -p %s && sudo chmod 700 %s && sudo chown %s %s && printf '%%s' '%s' | base64 -d | sudo tee %s > /dev/null && sudo chmod 600 %s && sudo chown %s %s",
+		dir, dir, owner, dir, encoded, file, file, owner, file,
+	)); err != nil {
+		return fmt.Errorf("Error copying registry credentials: %s", err)
+	}
+
+	return nil
+}
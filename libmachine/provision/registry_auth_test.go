@@ -0,0 +1,94 @@
+package provision
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthFile = `{
+	"auths": {
+		"quay.io": {"auth": "cXVheTpzZWNyZXQ="},
+		"https://registry.internal:5000/": {"auth": "aW50ZXJuYWw6c2VjcmV0"}
+	}
+}`
+
+func TestRegistryAuths(t *testing.T) {
+	auths, err := registryAuths([]byte(testAuthFile), nil)
+	assert.NoError(t, err)
+	assert.Len(t, auths, 2)
+
+	auths, err = registryAuths([]byte(testAuthFile), []string{"registry.internal:5000"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://registry.internal:5000/"}, keys(auths))
+
+	_, err = registryAuths([]byte(testAuthFile), []string{"docker.io"})
+	assert.EqualError(t, err, "No credentials for docker.io found, log in with podman login first")
+
+	_, err = registryAuths([]byte(`{"auths": {}}`), nil)
+	assert.Error(t, err)
+}
+
+func TestMergeRegistryAuths(t *testing.T) {
+	auths, _ := registryAuths([]byte(testAuthFile), []string{"quay.io"})
+
+	merged, err := mergeRegistryAuths(`{"auths": {"docker.io": {"auth": "ZG9ja2VyOnNlY3JldA=="}}, "credHelpers": {}}`, auths)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+	"auths": {
+		"docker.io": {
+			"auth": "ZG9ja2VyOnNlY3JldA=="
+		},
+		"quay.io": {
+			"auth": "cXVheTpzZWNyZXQ="
+		}
+	},
+	"credHelpers": {}
+}`, string(merged))
+}
+
+func TestSyncRegistryAuthRootless(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	authFile := filepath.Join(tmpDir, "auth.json")
+	ioutil.WriteFile(authFile, []byte(testAuthFile), 0600)
+
+	auths, _ := registryAuths([]byte(testAuthFile), []string{"quay.io"})
+	merged, _ := mergeRegistryAuths("", auths)
+
+	p := NewDebianProvisioner(&sshUserDriver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"id -u": "1000\n",
+			"sudo cat /run/user/1000/containers/auth.json 2>/dev/null || true": "",
+			fmt.Sprintf(
+				"sudo mkdir -p '/run/user/1000/containers' && sudo chmod 700 '/run/user/1000/containers' && sudo chown core '/run/user/1000/containers' && "+
+					"printf '%%s' '%s' | base64 -d | sudo tee '/run/user/1000/containers/auth.json' > /dev/null && sudo chmod 600 '/run/user/1000/containers/auth.json' && sudo chown core '/run/user/1000/containers/auth.json'",
+				base64.StdEncoding.EncodeToString(merged),
+			): "",
+		},
+	}
+
+	assert.NoError(t, SyncRegistryAuth(p, engine.Options{Rootless: true}, authFile, []string{"quay.io"}))
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,144 @@
+package provision
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+const (
+	// subIDStart is where useradd starts handing out subordinate ids, the
+	// ranges of the existing users are skipped
+	subIDStart = 100000
+	subIDCount = 65536
+)
+
+// nextSubIDRange returns the start of a free range of subordinate ids in
+// the content of /etc/subuid or /etc/subgid, after the ranges already given
+// out, and whether user already has one.
+func nextSubIDRange(content, user string) (int, bool) {
+	start := subIDStart
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == user {
+			return 0, true
+		}
+
+		first, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if first+count > start {
+			start = first + count
+		}
+	}
+
+	return start, false
+}
+
+// rootlessStorageOptions returns the storage options of a rootless user,
+// with the graph root in its home directory and the run root in its
+// runtime directory.
+func rootlessStorageOptions(p Provisioner, engineOptions engine.Options, home, uid string) (engine.Options, error) {
+	options := engine.Options{
+		StorageDriver: engineOptions.StorageDriver,
+		GraphDir:      path.Join(home, ".local/share/containers/storage"),
+		StorageOpts:   []string{fmt.Sprintf("runroot=/run/user/%s/containers", uid)},
+	}
+
+	for _, opt := range engineOptions.StorageOpts {
+		// the graph and run roots of root are not writable by the user
+		if strings.HasPrefix(opt, "runroot=") || strings.HasPrefix(opt, "graphroot=") {
+			continue
+		}
+		options.StorageOpts = append(options.StorageOpts, opt)
+	}
+
+	// kernels older than 5.13 only allow overlay mounts by unprivileged
+	// users through fuse-overlayfs
+	if fuseOverlayfs, err := p.SSHCommand("command -v fuse-overlayfs || true"); err != nil {
+		return options, err
+	} else if fuseOverlayfs = strings.TrimSpace(fuseOverlayfs); fuseOverlayfs != "" {
+		options.StorageOpts = append(options.StorageOpts, fmt.Sprintf("overlay.mount_program=%s", fuseOverlayfs))
+	}
+
+	return options, nil
+}
+
+// configureRootless sets up the SSH user to run Podman: subordinate user
+// and group ids, lingering so its services run without a session, its own
+// storage.conf and a podman.socket in its systemd user instance.
+func configureRootless(p Provisioner, engineOptions engine.Options) error {
+	user := p.GetDriver().GetSSHUsername()
+
+	log.Infof("Configuring rootless Podman for %s...", user)
+
+	for _, file := range []string{"/etc/subuid", "/etc/subgid"} {
+		content, err := p.SSHCommand(fmt.Sprintf("cat %s 2>/dev/null || true", file))
+		if err != nil {
+			return err
+		}
+
+		start, found := nextSubIDRange(content, user)
+		if found {
+			continue
+		}
+
+		if _, err := p.SSHCommand(fmt.Sprintf("echo '%s:%d:%d' | sudo tee -a %s", user, start, subIDCount, file)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.SSHCommand(fmt.Sprintf("sudo loginctl enable-linger %s", user)); err != nil {
+		return err
+	}
+
+	home, err := p.SSHCommand("echo $HOME")
+	if err != nil {
+		return err
+	}
+	home = strings.TrimSpace(home)
+
+	uid, err := p.SSHCommand("id -u")
+	if err != nil {
+		return err
+	}
+	uid = strings.TrimSpace(uid)
+
+	storageOptions, err := rootlessStorageOptions(p, engineOptions, home, uid)
+	if err != nil {
+		return err
+	}
+
+	storageConf, err := generateStorageConf(p, storageOptions)
+	if err != nil {
+		return err
+	}
+
+	configDir := path.Join(home, ".config/containers")
+	if err := WriteRemoteFile(p, path.Join(configDir, "storage.conf"), storageConf); err != nil {
+		return err
+	}
+
+	if _, err := p.SSHCommand(fmt.Sprintf("sudo chown -R %s: %s", user, path.Join(home, ".config"))); err != nil {
+		return err
+	}
+
+	// the runtime directory is only set in login sessions
+	if _, err := p.SSHCommand(fmt.Sprintf("XDG_RUNTIME_DIR=/run/user/%s systemctl --user enable --now podman.socket", uid)); err != nil {
+		return err
+	}
+
+	return nil
+}
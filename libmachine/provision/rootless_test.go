@@ -0,0 +1,71 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+type sshUserDriver struct {
+	fakedriver.Driver
+}
+
+func (d *sshUserDriver) GetSSHUsername() string {
+	return "core"
+}
+
+func TestRootlessStorageOptions(t *testing.T) {
+	p := NewDebianProvisioner(&sshUserDriver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"command -v fuse-overlayfs || true": "/usr/bin/fuse-overlayfs\n",
+		},
+	}
+
+	options, err := rootlessStorageOptions(p, engine.Options{
+		GraphDir:    "/mnt/data",
+		StorageOpts: []string{"graphroot=/mnt/data", "overlay.mountopt=nodev"},
+	}, "/home/core", "1000")
+
+	assert.NoError(t, err)
+	assert.Equal(t, engine.Options{
+		GraphDir: "/home/core/.local/share/containers/storage",
+		StorageOpts: []string{
+			"runroot=/run/user/1000/containers",
+			"overlay.mountopt=nodev",
+			"overlay.mount_program=/usr/bin/fuse-overlayfs",
+		},
+	}, options)
+}
+
+func TestNextSubIDRange(t *testing.T) {
+	testCases := []struct {
+		content string
+		start   int
+		found   bool
+	}{
+		{"", 100000, false},
+		{"core:100000:65536\n", 0, true},
+		{"fedora:100000:65536\n", 165536, false},
+		{"fedora:100000:65536\nbuild:300000:1000\nci:165536:65536\n", 301000, false},
+		{"# comment\nlow:1000:100\n", 100000, false},
+	}
+
+	for _, tc := range testCases {
+		start, found := nextSubIDRange(tc.content, "core")
+
+		assert.Equal(t, tc.found, found, tc.content)
+		assert.Equal(t, tc.start, start, tc.content)
+	}
+}
+
+func TestConfigurePodmanRootlessNeedsSystemd(t *testing.T) {
+	p := NewAlpineProvisioner(&sshUserDriver{})
+
+	err := configurePodman(p, engine.Options{Rootless: true})
+
+	assert.EqualError(t, err, "Rootless mode needs systemd, which the alpine provisioner does not use")
+}
@@ -0,0 +1,163 @@
+package provision
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/auth"
+	"github.com/thelonelyghost/p2box/libmachine/drivers"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/serviceaction"
+)
+
+func init() {
+	Register("SUSE", &RegisteredProvisioner{
+		New: NewSUSEProvisioner,
+	})
+}
+
+func NewSUSEProvisioner(d drivers.Driver) Provisioner {
+	return &SUSEProvisioner{
+		NewSystemdProvisioner("opensuse", d),
+	}
+}
+
+// SUSEProvisioner provisions openSUSE Leap, Tumbleweed and SLES.
+type SUSEProvisioner struct {
+	SystemdProvisioner
+}
+
+func (provisioner *SUSEProvisioner) String() string {
+	return "suse"
+}
+
+func (provisioner *SUSEProvisioner) CompatibleWithHost() bool {
+	switch provisioner.OsReleaseInfo.ID {
+	case "opensuse", "opensuse-leap", "opensuse-tumbleweed", "sles":
+		return true
+	}
+
+	for _, id := range strings.Fields(provisioner.OsReleaseInfo.IDLike) {
+		if id == "suse" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (provisioner *SUSEProvisioner) Package(name string, action pkgaction.PackageAction) error {
+	var packageAction string
+
+	switch action {
+	case pkgaction.Install:
+		packageAction = "install"
+	case pkgaction.Remove, pkgaction.Purge:
+		packageAction = "remove"
+	case pkgaction.Upgrade:
+		packageAction = "update"
+	}
+
+	command := fmt.Sprintf("sudo -E %szypper --non-interactive %s %s", proxyPrefix(provisioner.EngineOptions), packageAction, name)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (provisioner *SUSEProvisioner) PackageVersion(name string) (string, error) {
+	version, err := provisioner.SSHCommand(fmt.Sprintf("rpm -q --queryformat '%%{VERSION}-%%{RELEASE}' %s", name))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(version), nil
+}
+
+func (provisioner *SUSEProvisioner) InstallPackageVersion(name, version string) error {
+	command := fmt.Sprintf("sudo -E %szypper --non-interactive install --oldpackage '%s=%s'", proxyPrefix(provisioner.EngineOptions), name, version)
+
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// enableContainersModule registers the Containers module on SLES, which is
+// where podman is shipped. openSUSE has podman in its main repository.
+func (provisioner *SUSEProvisioner) enableContainersModule() error {
+	if provisioner.OsReleaseInfo.ID != "sles" {
+		return nil
+	}
+
+	if _, err := provisioner.SSHCommand("zypper --non-interactive search --match-exact podman"); err == nil {
+		return nil
+	}
+
+	log.Info("Enabling the SLES Containers module...")
+
+	arch, err := provisioner.SSHCommand("uname -m")
+	if err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("sudo SUSEConnect -p sle-module-containers/%s/%s", provisioner.OsReleaseInfo.VersionID, strings.TrimSpace(arch))
+	if _, err := provisioner.SSHCommand(command); err != nil {
+		return fmt.Errorf("error enabling the SLES Containers module: %s", err)
+	}
+
+	return nil
+}
+
+func (provisioner *SUSEProvisioner) Provision(authOptions auth.Options, engineOptions engine.Options) error {
+	var (
+		err error
+	)
+
+	provisioner.AuthOptions = authOptions
+	provisioner.EngineOptions = engineOptions
+
+	if err := provisioner.SetHostname(provisioner.Driver.GetMachineName()); err != nil {
+		return err
+	}
+
+	for _, pkg := range provisioner.Packages {
+		log.Debugf("installing base package: name=%s", pkg)
+		if err := provisioner.Package(pkg, pkgaction.Install); err != nil {
+			return err
+		}
+	}
+
+	if err := provisioner.enableContainersModule(); err != nil {
+		return err
+	}
+
+	if err := provisioner.Package("podman", pkgaction.Install); err != nil {
+		return err
+	}
+
+	if err := provisioner.Service("podman.socket", serviceaction.Enable); err != nil {
+		return err
+	}
+
+	if err := provisioner.Service("podman.socket", serviceaction.Start); err != nil {
+		return err
+	}
+
+	if err := configurePodman(provisioner, provisioner.EngineOptions); err != nil {
+		return err
+	}
+
+	provisioner.AuthOptions = setRemoteAuthOptions(provisioner)
+
+	if err := ConfigureAuth(provisioner); err != nil {
+		return err
+	}
+
+	return err
+}
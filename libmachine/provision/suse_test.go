@@ -0,0 +1,45 @@
+package provision
+
+import (
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/provision/pkgaction"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSUSECompatibleWithHost(t *testing.T) {
+	cases := []struct {
+		release    *OsRelease
+		compatible bool
+	}{
+		{&OsRelease{ID: "opensuse-leap", IDLike: "suse opensuse"}, true},
+		{&OsRelease{ID: "opensuse-tumbleweed", IDLike: "opensuse suse"}, true},
+		{&OsRelease{ID: "sles", IDLike: "suse"}, true},
+		{&OsRelease{ID: "sle-micro", IDLike: "suse"}, true},
+		{&OsRelease{ID: "fedora"}, false},
+		{&OsRelease{ID: "debian"}, false},
+	}
+
+	p := NewSUSEProvisioner(&fakedriver.Driver{})
+	for _, c := range cases {
+		p.SetOsReleaseInfo(c.release)
+		assert.Equal(t, c.compatible, p.CompatibleWithHost(), c.release.ID)
+	}
+}
+
+func TestSUSEPackage(t *testing.T) {
+	p := NewSUSEProvisioner(&fakedriver.Driver{}).(*SUSEProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo -E zypper --non-interactive install podman": "",
+			"sudo -E zypper --non-interactive remove htop":    "",
+			"sudo -E zypper --non-interactive update podman":  "",
+		},
+	}
+
+	assert.NoError(t, p.Package("podman", pkgaction.Install))
+	assert.NoError(t, p.Package("htop", pkgaction.Purge))
+	assert.NoError(t, p.Package("podman", pkgaction.Upgrade))
+}
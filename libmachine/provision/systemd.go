@@ -29,6 +29,10 @@ func NewSystemdProvisioner(osReleaseID string, d drivers.Driver) SystemdProvisio
 	}
 }
 
+func (p *SystemdProvisioner) systemdUnitDir() string {
+	return "/etc/systemd/system"
+}
+
 func (p *SystemdProvisioner) GenerateEngineOptions() (*EngineOptions, error) {
 	var (
 		engineCfg bytes.Buffer
@@ -37,7 +41,7 @@ func (p *SystemdProvisioner) GenerateEngineOptions() (*EngineOptions, error) {
 	driverNameLabel := fmt.Sprintf("provider=%s", p.Driver.DriverName())
 	p.EngineOptions.Labels = append(p.EngineOptions.Labels, driverNameLabel)
 
-	engineConfigTmpl := `--storage-driver {{.EngineOptions.StorageDriver}} --tlsverify --tlscacert {{.AuthOptions.CaCertRemotePath}} --tlscert {{.AuthOptions.ServerCertRemotePath}} --tlskey {{.AuthOptions.ServerKeyRemotePath}} {{ range .EngineOptions.Labels }}--label {{.}} {{ end }}{{ range .EngineOptions.InsecureRegistry }}--insecure-registry {{.}} {{ end }}{{ range .EngineOptions.RegistryMirror }}--registry-mirror {{.}} {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}} {{ end }}
+	engineConfigTmpl := `--storage-driver {{.EngineOptions.StorageDriver}} --tlsverify --tlscacert {{.AuthOptions.CaCertRemotePath}} --tlscert {{.AuthOptions.ServerCertRemotePath}} --tlskey {{.AuthOptions.ServerKeyRemotePath}} {{ range .EngineOptions.Labels }}--label {{.}} {{ end }}{{ range .EngineOptions.ArbitraryFlags }}--{{.}} {{ end }}
 Environment={{range .EngineOptions.Env}}{{ printf "%q" . }} {{end}}
 `
 	t, err := template.New("engineConfig").Parse(engineConfigTmpl)
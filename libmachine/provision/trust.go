@@ -0,0 +1,228 @@
+package provision
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/log"
+)
+
+// registryCertsDir holds the CA certificates trusted for a single registry,
+// in a directory named after it
+const registryCertsDir = "/etc/containers/certs.d"
+
+// hostCABundles are the places the CA bundle of the host is looked for, after
+// SSL_CERT_FILE. They follow the list of the Go standard library.
+var hostCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Gentoo, Arch
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS, RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine, macOS
+}
+
+// caTrustStore is implemented by the provisioners which know where their
+// distribution keeps the trusted CA certificates.
+type caTrustStore interface {
+	// caTrustDir is the directory the extra CA certificates go to.
+	caTrustDir() string
+	// updateCATrustCommand rebuilds the CA bundles from caTrustDir, if
+	// the distribution needs it.
+	updateCATrustCommand() string
+}
+
+func (provisioner *RedHatProvisioner) caTrustDir() string {
+	return "/etc/pki/ca-trust/source/anchors"
+}
+
+func (provisioner *RedHatProvisioner) updateCATrustCommand() string {
+	return "sudo update-ca-trust extract"
+}
+
+func (provisioner *CoreOSProvisioner) caTrustDir() string {
+	return "/etc/pki/ca-trust/source/anchors"
+}
+
+func (provisioner *CoreOSProvisioner) updateCATrustCommand() string {
+	return "sudo update-ca-trust extract"
+}
+
+func (provisioner *DebianProvisioner) caTrustDir() string {
+	return "/usr/local/share/ca-certificates"
+}
+
+func (provisioner *DebianProvisioner) updateCATrustCommand() string {
+	return "sudo update-ca-certificates"
+}
+
+func (provisioner *AlpineProvisioner) caTrustDir() string {
+	return "/usr/local/share/ca-certificates"
+}
+
+func (provisioner *AlpineProvisioner) updateCATrustCommand() string {
+	return "sudo update-ca-certificates"
+}
+
+func (provisioner *SUSEProvisioner) caTrustDir() string {
+	return "/etc/pki/trust/anchors"
+}
+
+func (provisioner *SUSEProvisioner) updateCATrustCommand() string {
+	return "sudo update-ca-certificates"
+}
+
+func (provisioner *Boot2PodmanProvisioner) caTrustDir() string {
+	return "/etc/ssl/certs"
+}
+
+func (provisioner *Boot2PodmanProvisioner) updateCATrustCommand() string {
+	// Podman reads every certificate of /etc/ssl/certs, there is no
+	// bundle to rebuild
+	return ""
+}
+
+// ParseTrustCA splits a [REGISTRY=]FILE CA certificate to trust. Without a
+// registry, the certificate is trusted by the whole machine.
+func ParseTrustCA(spec string) (string, string, error) {
+	registry := ""
+	file := spec
+
+	// a path may contain "=", a registry has no path separators
+	if i := strings.Index(spec, "="); i >= 0 && !strings.ContainsAny(spec[:i], `/\`) {
+		registry, file = spec[:i], spec[i+1:]
+		if registry == "" {
+			return "", "", fmt.Errorf("Invalid CA certificate %q, expected [REGISTRY=]FILE", spec)
+		}
+	}
+
+	if file == "" {
+		return "", "", fmt.Errorf("Invalid CA certificate %q, expected [REGISTRY=]FILE", spec)
+	}
+
+	return registry, file, nil
+}
+
+// FindHostCABundle returns the path of the CA bundle of the host.
+func FindHostCABundle() (string, error) {
+	candidates := hostCABundles
+	if sslCertFile := os.Getenv("SSL_CERT_FILE"); sslCertFile != "" {
+		candidates = append([]string{sslCertFile}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("No CA bundle found on this host, set SSL_CERT_FILE to its path")
+}
+
+// readCACertificate reads a PEM file, making sure it holds certificates.
+func readCACertificate(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Error reading CA certificate: %s", err)
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("Error reading CA certificate %s: no PEM encoded certificate found", file)
+	}
+
+	return string(content), nil
+}
+
+// caFileName names the copy of a certificate on the machine after the local
+// file, with the .crt extension that the trust stores and certs.d require.
+func caFileName(file string) string {
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".crt"
+}
+
+// trustsMachineWide reports whether some certificates go to the trust store
+// of the machine, rather than only to registries.
+func trustsMachineWide(engineOptions engine.Options) bool {
+	if engineOptions.InheritHostCAs {
+		return true
+	}
+
+	for _, spec := range engineOptions.TrustCAs {
+		if registry, _, err := ParseTrustCA(spec); err == nil && registry == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustedCAFiles returns the CA certificates to copy to the trust store of
+// the machine, and to the certs.d directories of their registries.
+func trustedCAFiles(p Provisioner, engineOptions engine.Options) ([]podmanConfigFile, error) {
+	files := []podmanConfigFile{}
+
+	ts, hasTrustStore := p.(caTrustStore)
+	if !hasTrustStore && trustsMachineWide(engineOptions) {
+		log.Warnf("The %s provisioner does not know the trust store of the machine, only CA certificates for a registry are copied", p.String())
+	}
+
+	if engineOptions.InheritHostCAs && hasTrustStore {
+		bundle, err := FindHostCABundle()
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := readCACertificate(bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, podmanConfigFile{path.Join(ts.caTrustDir(), "host-ca-bundle.crt"), content})
+	}
+
+	for _, spec := range engineOptions.TrustCAs {
+		registry, file, err := ParseTrustCA(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if registry == "" && !hasTrustStore {
+			continue
+		}
+
+		content, err := readCACertificate(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if registry == "" {
+			files = append(files, podmanConfigFile{path.Join(ts.caTrustDir(), caFileName(file)), content})
+		} else {
+			files = append(files, podmanConfigFile{path.Join(registryCertsDir, registry, caFileName(file)), content})
+		}
+	}
+
+	return files, nil
+}
+
+// updateCATrust rebuilds the CA bundles of the machine once the certificates
+// are in place.
+func updateCATrust(p Provisioner, engineOptions engine.Options) error {
+	ts, ok := p.(caTrustStore)
+	if !ok || !trustsMachineWide(engineOptions) || ts.updateCATrustCommand() == "" {
+		return nil
+	}
+
+	if _, err := p.SSHCommand(ts.updateCATrustCommand()); err != nil {
+		return fmt.Errorf("Error updating the trusted CA certificates: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package provision
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thelonelyghost/p2box/drivers/fakedriver"
+	"github.com/thelonelyghost/p2box/libmachine/engine"
+	"github.com/thelonelyghost/p2box/libmachine/provision/provisiontest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCACertificate = "-----BEGIN CERTIFICATE-----\nMIIBszCCAVmgAwIBAgIUB3p1\n-----END CERTIFICATE-----\n"
+
+func TestParseTrustCA(t *testing.T) {
+	cases := []struct {
+		spec     string
+		registry string
+		file     string
+	}{
+		{"corp-root.pem", "", "corp-root.pem"},
+		{"registry.internal:5000=corp-root.pem", "registry.internal:5000", "corp-root.pem"},
+		{"/home/user/a=b/corp-root.pem", "", "/home/user/a=b/corp-root.pem"},
+		{`C:\certs\corp-root.pem`, "", `C:\certs\corp-root.pem`},
+	}
+
+	for _, c := range cases {
+		registry, file, err := ParseTrustCA(c.spec)
+		assert.NoError(t, err, c.spec)
+		assert.Equal(t, c.registry, registry, c.spec)
+		assert.Equal(t, c.file, file, c.spec)
+	}
+
+	for _, spec := range []string{"", "=corp-root.pem", "registry.internal="} {
+		_, _, err := ParseTrustCA(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestTrustedCAFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	corpRoot := filepath.Join(tmpDir, "corp-root.pem")
+	registryCA := filepath.Join(tmpDir, "registry.crt")
+	ioutil.WriteFile(corpRoot, []byte(testCACertificate), 0644)
+	ioutil.WriteFile(registryCA, []byte(testCACertificate), 0644)
+
+	p := NewFedoraProvisioner(&fakedriver.Driver{})
+
+	files, err := trustedCAFiles(p, engine.Options{
+		TrustCAs: []string{corpRoot, "registry.internal:5000=" + registryCA},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []podmanConfigFile{
+		{"/etc/pki/ca-trust/source/anchors/corp-root.crt", testCACertificate},
+		{"/etc/containers/certs.d/registry.internal:5000/registry.crt", testCACertificate},
+	}, files)
+}
+
+func TestTrustedCAFilesInheritHostCAs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle := filepath.Join(tmpDir, "bundle.pem")
+	ioutil.WriteFile(bundle, []byte(testCACertificate), 0644)
+
+	defer os.Setenv("SSL_CERT_FILE", os.Getenv("SSL_CERT_FILE"))
+	os.Setenv("SSL_CERT_FILE", bundle)
+
+	files, err := trustedCAFiles(NewBoot2PodmanProvisioner(&fakedriver.Driver{}), engine.Options{InheritHostCAs: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []podmanConfigFile{{"/etc/ssl/certs/host-ca-bundle.crt", testCACertificate}}, files)
+}
+
+func TestTrustedCAFilesNotPEM(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "machine-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	notPEM := filepath.Join(tmpDir, "corp-root.der")
+	ioutil.WriteFile(notPEM, []byte{0x30, 0x82}, 0644)
+
+	_, err = trustedCAFiles(NewFedoraProvisioner(&fakedriver.Driver{}), engine.Options{TrustCAs: []string{notPEM}})
+
+	assert.Error(t, err)
+}
+
+func TestUpdateCATrust(t *testing.T) {
+	p := NewDebianProvisioner(&fakedriver.Driver{}).(*DebianProvisioner)
+	p.SSHCommander = &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo update-ca-certificates": "",
+		},
+	}
+
+	assert.NoError(t, updateCATrust(p, engine.Options{TrustCAs: []string{"corp-root.pem"}}))
+
+	// certificates for a registry only need certs.d
+	p.SSHCommander = &provisiontest.FakeSSHCommander{}
+	assert.NoError(t, updateCATrust(p, engine.Options{TrustCAs: []string{"registry.internal=corp-root.pem"}}))
+}
@@ -1,6 +1,7 @@
 package provision
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	//"net/url"
@@ -137,6 +138,52 @@ func ConfigureAuth(p Provisioner) error {
 	return nil
 }
 
+// remoteChunkSize bounds the base64 content in a command, well below the
+// 128 KiB a single argument may have on Linux
+var remoteChunkSize = 64 * 1024
+
+// WriteRemoteFile creates or replaces a file owned by root on the machine.
+// The content is base64 encoded, so it needs no shell quoting. Large files
+// are sent in chunks, appended to a temporary file next to the file.
+func WriteRemoteFile(p SSHCommander, filePath, content string) error {
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	dir, file := shellQuote(path.Dir(filePath)), shellQuote(filePath)
+
+	if len(encoded) <= remoteChunkSize {
+		command := fmt.Sprintf("sudo mkdir -p %s && printf '%%s' '%s' | base64 -d | sudo tee %s > /dev/null", dir, encoded, file)
+		if _, err := p.SSHCommand(command); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	tmp := shellQuote(filePath + ".base64")
+	if _, err := p.SSHCommand(fmt.Sprintf("sudo mkdir -p %s && sudo rm -f %s", dir, tmp)); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(encoded); start += remoteChunkSize {
+		end := start + remoteChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		if _, err := p.SSHCommand(fmt.Sprintf("printf '%%s' '%s' | sudo tee -a %s > /dev/null", encoded[start:end], tmp)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.SSHCommand(fmt.Sprintf("sudo base64 -d %s | sudo tee %s > /dev/null && sudo rm -f %s", tmp, file, tmp)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// shellQuote quotes a word for the shell of the machine.
+func shellQuote(word string) string {
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
 func matchNetstatOut(reDaemonListening, netstatOut string) bool {
 	// TODO: I would really prefer this be a Scanner directly on
 	// the STDOUT of the executed command than to do all the string
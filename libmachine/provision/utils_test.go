@@ -109,3 +109,45 @@ func TestGetFilesystemType(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "btrfs", fsType)
 }
+
+func TestWriteRemoteFile(t *testing.T) {
+	commander := &provisiontest.FakeSSHCommander{
+		Responses: map[string]string{
+			"sudo mkdir -p '/etc/containers' && printf '%s' 'aW5zZWN1cmUgPSB0cnVlCg==' | base64 -d | sudo tee '/etc/containers/registries.conf' > /dev/null": "",
+		},
+	}
+
+	assert.NoError(t, WriteRemoteFile(commander, "/etc/containers/registries.conf", "insecure = true\n"))
+}
+
+// recordingSSHCommander records the commands it runs.
+type recordingSSHCommander struct {
+	commands []string
+}
+
+func (c *recordingSSHCommander) SSHCommand(args string) (string, error) {
+	c.commands = append(c.commands, args)
+	return "", nil
+}
+
+func TestWriteRemoteFileInChunks(t *testing.T) {
+	defer func(size int) { remoteChunkSize = size }(remoteChunkSize)
+	remoteChunkSize = 8
+
+	commander := &recordingSSHCommander{}
+
+	// encoded as aW5zZWN1cmUgPSB0cnVlCg==
+	assert.NoError(t, WriteRemoteFile(commander, "/etc/my dir/registries.conf", "insecure = true\n"))
+	assert.Equal(t, []string{
+		"sudo mkdir -p '/etc/my dir' && sudo rm -f '/etc/my dir/registries.conf.base64'",
+		"printf '%s' 'aW5zZWN1' | sudo tee -a '/etc/my dir/registries.conf.base64' > /dev/null",
+		"printf '%s' 'cmUgPSB0' | sudo tee -a '/etc/my dir/registries.conf.base64' > /dev/null",
+		"printf '%s' 'cnVlCg==' | sudo tee -a '/etc/my dir/registries.conf.base64' > /dev/null",
+		"sudo base64 -d '/etc/my dir/registries.conf.base64' | sudo tee '/etc/my dir/registries.conf' > /dev/null && sudo rm -f '/etc/my dir/registries.conf.base64'",
+	}, commander.commands)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'/etc/a b;c'`, shellQuote("/etc/a b;c"))
+	assert.Equal(t, `'/etc/it'\''s'`, shellQuote("/etc/it's"))
+}